@@ -0,0 +1,136 @@
+package mongoproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// newAdminServer returns an HTTP server exposing the admin API.
+//
+//	GET  /barriers                  connection IDs parked on each barrier
+//	POST /barriers/{name}/release   release the longest-parked message, or
+//	                                bank the release if none is parked
+//	     ?conn=ID                   release the message parked by connection ID
+//	     ?all=true                  release every parked message
+//	GET  /connections               open connections
+//	POST /connections/close         close every connection
+//	     ?app=NAME                  only those with this application name
+//	     ?addr=HOST[:PORT]          only those from this client address
+//	     ?kind=monitoring|rtt|pool  only those used for this
+//	POST /freeze                    stop forwarding in both directions
+//	POST /resume                    forward again
+//	GET  /status                    everything proxyStatus returns
+//	POST /reset                     back to plain forwarding, as proxyReset
+func (p *Proxy) newAdminServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /barriers", p.handleBarriers)
+	mux.HandleFunc("POST /barriers/{name}/release", p.handleBarrierRelease)
+	mux.HandleFunc("GET /connections", p.handleConnections)
+	mux.HandleFunc("POST /connections/close", p.handleConnectionsClose)
+	mux.HandleFunc("POST /freeze", p.handleFreeze)
+	mux.HandleFunc("POST /resume", p.handleResume)
+	mux.HandleFunc("GET /status", p.handleStatus)
+	mux.HandleFunc("POST /reset", p.handleReset)
+
+	return &http.Server{Handler: mux}
+}
+
+// serveAdmin runs srv on ln until it fails or is shut down.
+func serveAdmin(srv *http.Server, ln net.Listener) error {
+	log.Printf("Admin server listening on %s", ln.Addr())
+
+	err := srv.Serve(ln)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve admin API on %s: %w", ln.Addr(), err)
+	}
+
+	return nil
+}
+
+func (p *Proxy) handleBarriers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, p.barriers.all())
+}
+
+func (p *Proxy) handleBarrierRelease(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	query := r.URL.Query()
+
+	switch {
+	case query.Get("all") == "true":
+		writeJSON(w, http.StatusOK, map[string]int{"released": p.ReleaseAll(name)})
+	case query.Has("conn"):
+		connID, err := strconv.ParseInt(query.Get("conn"), 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid conn: " + err.Error()})
+			return
+		}
+		if !p.ReleaseConn(name, connID) {
+			writeJSON(w, http.StatusNotFound, map[string]string{
+				"error": fmt.Sprintf("connection %d has nothing parked on barrier %q", connID, name),
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"released": 1})
+	default:
+		if !p.Release(name) {
+			writeJSON(w, http.StatusOK, map[string]int{"banked": 1})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"released": 1})
+	}
+}
+
+func (p *Proxy) handleConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, p.Connections())
+}
+
+func (p *Proxy) handleConnectionsClose(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	closed := p.CloseConnections(ConnFilter{
+		AppName:    query.Get("app"),
+		RemoteAddr: query.Get("addr"),
+		Kind:       query.Get("kind"),
+	})
+	writeJSON(w, http.StatusOK, map[string]int{"closed": closed})
+}
+
+func (p *Proxy) handleFreeze(w http.ResponseWriter, r *http.Request) {
+	p.Freeze()
+	writeJSON(w, http.StatusOK, map[string]bool{"frozen": true})
+}
+
+func (p *Proxy) handleResume(w http.ResponseWriter, r *http.Request) {
+	p.Resume()
+	writeJSON(w, http.StatusOK, map[string]bool{"frozen": false})
+}
+
+func (p *Proxy) handleStatus(w http.ResponseWriter, r *http.Request) {
+	body, err := bson.MarshalExtJSON(p.statusDocument(), false, false)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (p *Proxy) handleReset(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]int{"disarmed": p.Reset()})
+}
+
+// writeJSON writes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write admin response: %v", err)
+	}
+}
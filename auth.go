@@ -0,0 +1,89 @@
+package mongoproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// isAuthCommand reports whether name is one of the commands that carry an
+// authentication conversation.
+func isAuthCommand(name string) bool {
+	switch name {
+	case "saslStart", "saslContinue", "authenticate":
+		return true
+	}
+	return false
+}
+
+// corruptServerSignature flips a bit of the SCRAM server signature ("v=...")
+// in a saslContinue reply, or in the speculativeAuthenticate document of a
+// hello reply, so the client's verification of the server fails. It reports
+// whether the reply carried a signature.
+func corruptServerSignature(reply bson.Raw) (bson.Raw, bool, error) {
+	var doc bson.D
+	if err := bson.Unmarshal(reply, &doc); err != nil {
+		return nil, false, fmt.Errorf("failed to unmarshal reply: %w", err)
+	}
+
+	found := corruptPayload(doc)
+	for i, elem := range doc {
+		if nested, ok := elem.Value.(bson.D); ok && elem.Key == "speculativeAuthenticate" {
+			found = corruptPayload(nested) || found
+			doc[i].Value = nested
+		}
+	}
+	if !found {
+		return reply, false, nil
+	}
+
+	raw, err := bson.Marshal(doc)
+	return raw, true, err
+}
+
+// corruptPayload corrupts the server signature in the payload field of doc,
+// if there is one.
+func corruptPayload(doc bson.D) bool {
+	for i, elem := range doc {
+		if elem.Key != "payload" {
+			continue
+		}
+
+		payload, ok := elem.Value.(bson.Binary)
+		if !ok {
+			return false
+		}
+
+		corrupted, ok := corruptSignature(payload.Data)
+		if !ok {
+			return false
+		}
+		doc[i].Value = bson.Binary{Subtype: payload.Subtype, Data: corrupted}
+		return true
+	}
+	return false
+}
+
+// corruptSignature returns a SCRAM server-final message with a signature that
+// will not verify.
+func corruptSignature(msg []byte) ([]byte, bool) {
+	attrs := bytes.Split(msg, []byte(","))
+	for i, attr := range attrs {
+		encoded, ok := bytes.CutPrefix(attr, []byte("v="))
+		if !ok {
+			continue
+		}
+
+		sig, err := base64.StdEncoding.DecodeString(string(encoded))
+		if err != nil || len(sig) == 0 {
+			return nil, false
+		}
+		sig[0] ^= 0xff
+
+		attrs[i] = append([]byte("v="), base64.StdEncoding.EncodeToString(sig)...)
+		return bytes.Join(attrs, []byte(",")), true
+	}
+	return nil, false
+}
@@ -0,0 +1,63 @@
+package mongoproxy
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestCorruptSignature(t *testing.T) {
+	sig := base64.StdEncoding.EncodeToString([]byte("signature"))
+
+	corrupted, ok := corruptSignature([]byte("v=" + sig))
+	require.True(t, ok)
+	require.True(t, strings.HasPrefix(string(corrupted), "v="))
+	require.NotEqual(t, "v="+sig, string(corrupted))
+
+	_, ok = corruptSignature([]byte("r=nonce,s=salt,i=4096"))
+	require.False(t, ok, "server-first messages carry no signature")
+}
+
+func TestCorruptServerSignature(t *testing.T) {
+	sig := base64.StdEncoding.EncodeToString([]byte("signature"))
+	payload := bson.Binary{Data: []byte("v=" + sig)}
+
+	payloadOf := func(v bson.RawValue) string {
+		_, data := v.Binary()
+		return string(data)
+	}
+
+	reply := marshalDoc(t, bson.D{
+		{Key: "conversationId", Value: int32(1)},
+		{Key: "done", Value: false},
+		{Key: "payload", Value: payload},
+		{Key: "ok", Value: 1.0},
+	})
+	corrupted, found, err := corruptServerSignature(reply)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.NotEqual(t, "v="+sig, payloadOf(corrupted.Lookup("payload")))
+	require.Equal(t, 1.0, corrupted.Lookup("ok").Double())
+
+	hello := marshalDoc(t, bson.D{
+		{Key: "isWritablePrimary", Value: true},
+		{Key: "speculativeAuthenticate", Value: bson.D{{Key: "payload", Value: payload}}},
+		{Key: "ok", Value: 1.0},
+	})
+	corrupted, found, err = corruptServerSignature(hello)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.NotEqual(t, "v="+sig, payloadOf(corrupted.Lookup("speculativeAuthenticate", "payload")))
+
+	first := marshalDoc(t, bson.D{
+		{Key: "payload", Value: bson.Binary{Data: []byte("r=nonce,s=salt,i=4096")}},
+		{Key: "ok", Value: 1.0},
+	})
+	unchanged, found, err := corruptServerSignature(first)
+	require.NoError(t, err)
+	require.False(t, found)
+	require.Equal(t, first, unchanged)
+}
@@ -0,0 +1,233 @@
+package mongoproxy
+
+import (
+	"context"
+	"sync"
+)
+
+// Held returns the IDs of the connections with a message parked on the named
+// barrier, in arrival order.
+func (p *Proxy) Held(name string) []int64 {
+	return p.barriers.held(name)
+}
+
+// WaitHeld blocks until at least n messages are parked on the named barrier,
+// or ctx is done.
+func (p *Proxy) WaitHeld(ctx context.Context, name string, n int) error {
+	return p.barriers.waitHeld(ctx, name, n)
+}
+
+// Release lets the longest-parked message on the named barrier through. If
+// none is parked yet, the next message to reach the barrier passes straight
+// through. It reports whether a parked message was released rather than the
+// release banked.
+func (p *Proxy) Release(name string) bool {
+	return p.barriers.release(name)
+}
+
+// ReleaseConn lets the message parked on the named barrier by the given
+// connection through, so tests can choose the order across connections. It
+// reports whether that connection had a message parked.
+func (p *Proxy) ReleaseConn(name string, connID int64) bool {
+	return p.barriers.releaseConn(name, connID)
+}
+
+// ReleaseAll lets every message parked on the named barrier through and
+// returns how many there were.
+func (p *Proxy) ReleaseAll(name string) int {
+	return p.barriers.releaseAll(name)
+}
+
+// barrierWaiter is a message parked on a barrier.
+type barrierWaiter struct {
+	connID  int64
+	release chan struct{}
+}
+
+// barrier parks messages until the test releases them. Releases that arrive
+// before any message is parked are banked and let the next arrivals through.
+type barrier struct {
+	waiters []*barrierWaiter // in arrival order
+	permits int              // releases banked for future arrivals
+}
+
+// barrierSet holds a proxy's barriers by name. The zero value is ready to use.
+type barrierSet struct {
+	mu       sync.Mutex
+	barriers map[string]*barrier
+	changed  chan struct{} // closed and replaced whenever a waiter arrives
+}
+
+// get returns the named barrier, creating it if needed. The caller must hold
+// bs.mu.
+func (bs *barrierSet) get(name string) *barrier {
+	if bs.barriers == nil {
+		bs.barriers = make(map[string]*barrier)
+	}
+
+	b, ok := bs.barriers[name]
+	if !ok {
+		b = &barrier{}
+		bs.barriers[name] = b
+	}
+	return b
+}
+
+// notify wakes everyone waiting for the set to change. The caller must hold
+// bs.mu.
+func (bs *barrierSet) notify() {
+	if bs.changed != nil {
+		close(bs.changed)
+	}
+	bs.changed = make(chan struct{})
+}
+
+// wait parks the calling connection on the named barrier until it is
+// released or ctx is done. It reports whether it was released. A release that
+// races ctx is banked again, so the next arrival gets it instead.
+func (bs *barrierSet) wait(ctx context.Context, name string, connID int64) bool {
+	bs.mu.Lock()
+	b := bs.get(name)
+	if b.permits > 0 {
+		b.permits--
+		bs.mu.Unlock()
+		return true
+	}
+
+	w := &barrierWaiter{connID: connID, release: make(chan struct{})}
+	b.waiters = append(b.waiters, w)
+	bs.notify()
+	bs.mu.Unlock()
+
+	select {
+	case <-w.release:
+		return true
+	case <-ctx.Done():
+		bs.mu.Lock()
+		defer bs.mu.Unlock()
+
+		select {
+		case <-w.release:
+			b.permits++
+			return false
+		default:
+		}
+
+		for i, other := range b.waiters {
+			if other == w {
+				b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+				break
+			}
+		}
+		return false
+	}
+}
+
+// held returns the connection IDs parked on the named barrier, in arrival
+// order.
+func (bs *barrierSet) held(name string) []int64 {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	b, ok := bs.barriers[name]
+	if !ok {
+		return nil
+	}
+
+	ids := make([]int64, len(b.waiters))
+	for i, w := range b.waiters {
+		ids[i] = w.connID
+	}
+	return ids
+}
+
+// all returns the connection IDs parked on every barrier that has any.
+func (bs *barrierSet) all() map[string][]int64 {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	out := make(map[string][]int64)
+	for name, b := range bs.barriers {
+		if len(b.waiters) == 0 {
+			continue
+		}
+		for _, w := range b.waiters {
+			out[name] = append(out[name], w.connID)
+		}
+	}
+	return out
+}
+
+// waitHeld blocks until at least n messages are parked on the named barrier.
+func (bs *barrierSet) waitHeld(ctx context.Context, name string, n int) error {
+	for {
+		bs.mu.Lock()
+		b := bs.get(name)
+		if len(b.waiters) >= n {
+			bs.mu.Unlock()
+			return nil
+		}
+		if bs.changed == nil {
+			bs.changed = make(chan struct{})
+		}
+		changed := bs.changed
+		bs.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release lets the longest-parked message on the named barrier through. If
+// none is parked, the release is banked for the next arrival. It reports
+// whether a parked message was released.
+func (bs *barrierSet) release(name string) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	b := bs.get(name)
+	if len(b.waiters) == 0 {
+		b.permits++
+		return false
+	}
+
+	close(b.waiters[0].release)
+	b.waiters = b.waiters[1:]
+	return true
+}
+
+// releaseConn lets the message parked on the named barrier by connID through.
+// It reports whether one was parked.
+func (bs *barrierSet) releaseConn(name string, connID int64) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	b := bs.get(name)
+	for i, w := range b.waiters {
+		if w.connID == connID {
+			close(w.release)
+			b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// releaseAll lets every message parked on the named barrier through and
+// returns how many there were. Banked releases are discarded.
+func (bs *barrierSet) releaseAll(name string) int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	b := bs.get(name)
+	n := len(b.waiters)
+	for _, w := range b.waiters {
+		close(w.release)
+	}
+	b.waiters = nil
+	b.permits = 0
+	return n
+}
@@ -0,0 +1,92 @@
+package mongoproxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBarrierReleaseOrder(t *testing.T) {
+	var bs barrierSet
+	ctx := context.Background()
+
+	released := make(chan int64, 2)
+	for _, connID := range []int64{1, 2} {
+		go func() {
+			if bs.wait(ctx, "b", connID) {
+				released <- connID
+			}
+		}()
+		require.NoError(t, bs.waitHeld(ctx, "b", int(connID)))
+	}
+
+	require.Equal(t, []int64{1, 2}, bs.held("b"))
+
+	// Release the second arrival first.
+	require.True(t, bs.releaseConn("b", 2))
+	require.Equal(t, int64(2), <-released)
+
+	require.True(t, bs.release("b"))
+	require.Equal(t, int64(1), <-released)
+
+	require.Empty(t, bs.held("b"))
+}
+
+func TestBarrierBankedRelease(t *testing.T) {
+	var bs barrierSet
+
+	require.False(t, bs.release("b"), "nothing is parked yet")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.True(t, bs.wait(ctx, "b", 1), "a banked release should let the next arrival through")
+}
+
+func TestBarrierWaitCanceled(t *testing.T) {
+	var bs barrierSet
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	require.False(t, bs.wait(ctx, "b", 1))
+	require.Empty(t, bs.held("b"), "canceled waiters must be removed")
+}
+
+func TestBarrierReleaseAll(t *testing.T) {
+	var bs barrierSet
+	ctx := context.Background()
+
+	done := make(chan bool, 3)
+	for i := int64(1); i <= 3; i++ {
+		go func() { done <- bs.wait(ctx, "b", i) }()
+	}
+	require.NoError(t, bs.waitHeld(ctx, "b", 3))
+
+	require.Equal(t, 3, bs.releaseAll("b"))
+	for i := 0; i < 3; i++ {
+		require.True(t, <-done)
+	}
+}
+
+func TestBarrierReleaseRacesCancel(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		var bs barrierSet
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan bool)
+		go func() { done <- bs.wait(ctx, "b", 1) }()
+		require.NoError(t, bs.waitHeld(context.Background(), "b", 1))
+
+		go cancel()
+		bs.release("b")
+
+		if !<-done {
+			next, stop := context.WithTimeout(context.Background(), time.Second)
+			require.True(t, bs.wait(next, "b", 2), "a release the canceled waiter missed should be banked")
+			stop()
+		}
+	}
+}
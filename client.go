@@ -0,0 +1,71 @@
+package mongoproxy
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// ClientMetadata is what a driver says about itself in the client field of
+// its handshake.
+type ClientMetadata struct {
+	AppName       string `json:"appName,omitempty" bson:"appName,omitempty"`
+	DriverName    string `json:"driverName,omitempty" bson:"driverName,omitempty"`
+	DriverVersion string `json:"driverVersion,omitempty" bson:"driverVersion,omitempty"`
+	OSType        string `json:"osType,omitempty" bson:"osType,omitempty"`
+	OSName        string `json:"osName,omitempty" bson:"osName,omitempty"`
+	OSArch        string `json:"osArch,omitempty" bson:"osArch,omitempty"`
+	OSVersion     string `json:"osVersion,omitempty" bson:"osVersion,omitempty"`
+	Platform      string `json:"platform,omitempty" bson:"platform,omitempty"`
+}
+
+// parseClientMetadata returns the client metadata of a hello command. Missing
+// fields are left empty.
+func parseClientMetadata(hello bson.Raw) ClientMetadata {
+	str := func(path ...string) string {
+		s, _ := hello.Lookup(append([]string{"client"}, path...)...).StringValueOK()
+		return s
+	}
+
+	return ClientMetadata{
+		AppName:       str("application", "name"),
+		DriverName:    str("driver", "name"),
+		DriverVersion: str("driver", "version"),
+		OSType:        str("os", "type"),
+		OSName:        str("os", "name"),
+		OSArch:        str("os", "architecture"),
+		OSVersion:     str("os", "version"),
+		Platform:      str("platform"),
+	}
+}
+
+// driver returns the driver's name and version, as "name/version".
+func (m ClientMetadata) driver() string {
+	if m.DriverVersion == "" {
+		return m.DriverName
+	}
+	return m.DriverName + "/" + m.DriverVersion
+}
+
+// String describes the client for logs, leaving out what it did not send.
+func (m ClientMetadata) String() string {
+	var parts []string
+	if m.AppName != "" {
+		parts = append(parts, fmt.Sprintf("app=%q", m.AppName))
+	}
+	if m.DriverName != "" {
+		parts = append(parts, fmt.Sprintf("driver=%s", m.driver()))
+	}
+	if m.OSType != "" {
+		os := m.OSType
+		if m.OSArch != "" {
+			os += "/" + m.OSArch
+		}
+		parts = append(parts, fmt.Sprintf("os=%s", os))
+	}
+	if m.Platform != "" {
+		parts = append(parts, fmt.Sprintf("platform=%q", m.Platform))
+	}
+	return strings.Join(parts, " ")
+}
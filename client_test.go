@@ -0,0 +1,33 @@
+package mongoproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestParseClientMetadata(t *testing.T) {
+	hello := marshalDoc(t, bson.D{
+		{Key: "hello", Value: 1},
+		{Key: "client", Value: bson.D{
+			{Key: "application", Value: bson.D{{Key: "name", Value: "reports"}}},
+			{Key: "driver", Value: bson.D{{Key: "name", Value: "mongo-go-driver"}, {Key: "version", Value: "2.2.0"}}},
+			{Key: "os", Value: bson.D{{Key: "type", Value: "linux"}, {Key: "architecture", Value: "amd64"}}},
+			{Key: "platform", Value: "go1.24.0"},
+		}},
+	})
+
+	meta := parseClientMetadata(hello)
+	require.Equal(t, ClientMetadata{
+		AppName:       "reports",
+		DriverName:    "mongo-go-driver",
+		DriverVersion: "2.2.0",
+		OSType:        "linux",
+		OSArch:        "amd64",
+		Platform:      "go1.24.0",
+	}, meta)
+	require.Equal(t, `app="reports" driver=mongo-go-driver/2.2.0 os=linux/amd64 platform="go1.24.0"`, meta.String())
+
+	require.Equal(t, ClientMetadata{}, parseClientMetadata(marshalDoc(t, bson.D{{Key: "hello", Value: 1}})))
+}
@@ -1,19 +1,43 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 
 	"github.com/prestonvasquez/mongoproxy"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		validate(os.Args[2:])
+		return
+	}
+
 	// Optional flags. Leave them blank/zero to keep library defaults.
 	listen := flag.String("listen", "", "proxy listen address, e.g. :27018 (default: library default)")
 	target := flag.String("target", "", "upstream MongoDB address, e.g. localhost:27017 (default: library default)")
 	targetURI := flag.String("target-uri", "", "upstream MongoDB URI, e.g. mongodb://localhost:27017 (default: library default)")
 	caFile := flag.String("ca-file", "", "CA file for TLS connections (default: none)")
 	keyFile := flag.String("key-file", "", "Key file for TLS connections (default: none)")
+	metrics := flag.String("metrics", "", "address to serve Prometheus metrics on, e.g. :9090 (default: disabled)")
+	admin := flag.String("admin", "", "address to serve the admin HTTP API on, e.g. :9091 (default: disabled)")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP collector to export command spans to, e.g. localhost:4318 (default: disabled)")
+	pcapFile := flag.String("pcap", "", "pcapng file to capture every wire message to, e.g. capture.pcapng (default: disabled)")
+	tail := flag.Bool("tail", false, "print every command and reply passing through the proxy to stdout")
+	tailPretty := flag.Bool("tail-pretty", false, "print tailed messages as indented Extended JSON instead of one line each")
+	tailCommands := flag.String("tail-commands", "", "comma-separated command names to tail, e.g. find,insert (default: all)")
+	tailNamespaces := flag.String("tail-ns", "", "comma-separated namespaces to tail, e.g. test or test.coll (default: all)")
+	tailConns := flag.String("tail-conns", "", "comma-separated connection IDs to tail, e.g. 1,3 (default: all)")
+	testKeys := flag.String("test-keys", "", "comma-separated command fields to read test instructions from, e.g. proxyTestA (default: proxyTest)")
+	keepTestKeys := flag.Bool("keep-test-keys", false, "forward test instruction fields to the server instead of removing them")
+	commentInstructions := flag.Bool("comment-instructions", false, "also read test instructions from the command's comment")
+	scenario := flag.String("scenario", "", "YAML or JSON scenario file declaring listeners, targets and fault phases (default: none)")
 
 	flag.Parse()
 
@@ -34,9 +58,89 @@ func main() {
 	if *keyFile != "" {
 		opts = append(opts, mongoproxy.WithKeyFile(*keyFile))
 	}
+	if *metrics != "" {
+		opts = append(opts, mongoproxy.WithMetricsAddr(*metrics))
+	}
+	if *admin != "" {
+		opts = append(opts, mongoproxy.WithAdminAddr(*admin))
+	}
+	if *otlpEndpoint != "" {
+		opts = append(opts, mongoproxy.WithOTLPEndpoint(*otlpEndpoint))
+	}
+	if *pcapFile != "" {
+		opts = append(opts, mongoproxy.WithPcapFile(*pcapFile))
+	}
+	if keys := splitList(*testKeys); len(keys) > 0 {
+		opts = append(opts, mongoproxy.WithTestKeys(keys...))
+	}
+	if *keepTestKeys {
+		opts = append(opts, mongoproxy.WithKeepTestKeys(true))
+	}
+	if *commentInstructions {
+		opts = append(opts, mongoproxy.WithCommentInstructions(true))
+	}
+	if *tail {
+		tailOpts := mongoproxy.TailOptions{
+			Pretty:     *tailPretty,
+			Commands:   splitList(*tailCommands),
+			Namespaces: splitList(*tailNamespaces),
+		}
+		for _, s := range splitList(*tailConns) {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				log.Fatalf("invalid connection ID %q in -tail-conns: %v", s, err)
+			}
+			tailOpts.ConnIDs = append(tailOpts.ConnIDs, id)
+		}
+		opts = append(opts, mongoproxy.WithTail(tailOpts))
+	}
+
+	if *scenario != "" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		if err := mongoproxy.RunScenario(ctx, *scenario, opts...); err != nil {
+			log.Fatalf("failed to run scenario: %v", err)
+		}
+		return
+	}
 
 	// Start the proxy.
 	if err := mongoproxy.ListenAndServe(opts...); err != nil {
 		log.Fatalf("failed to start proxy: %v", err)
 	}
 }
+
+// validate implements "mongoproxy validate FILE...", which checks scenario
+// files without running them.
+func validate(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: mongoproxy validate FILE...")
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, path := range args {
+		if err := mongoproxy.ValidateScenario(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: ok\n", path)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
@@ -0,0 +1,64 @@
+package mongoproxy
+
+import "go.mongodb.org/mongo-driver/v2/bson"
+
+// connKind is what a connection is used for, as far as its commands tell.
+type connKind int
+
+const (
+	kindUnknown    connKind = iota // nothing but the handshake yet
+	kindMonitoring                 // answers a server monitor's hellos, streamed or polled
+	kindRTT                        // measures round trip times with plain hellos
+	kindPool                       // runs application commands
+)
+
+// String returns the name rules and filters use for the kind.
+func (k connKind) String() string {
+	switch k {
+	case kindMonitoring:
+		return "monitoring"
+	case kindRTT:
+		return "rtt"
+	case kindPool:
+		return "pool"
+	default:
+		return ""
+	}
+}
+
+// classify returns the kind of a connection that was of the given kind before
+// sending the command name, its handshake aside. exhaust reports whether the
+// command was sent with exhaustAllowed, and polling whether the server's last
+// hello reply on the connection lacked a topologyVersion, so the driver cannot
+// stream. Drivers never use a connection for more than one purpose, so the
+// first telling command decides: a streaming hello, carrying topologyVersion
+// and maxAwaitTimeMS or sent with exhaustAllowed, is a monitor's, and so is
+// any other hello to a server that does not stream, since drivers only
+// measure round trip times separately when it does. Another hello is an RTT
+// measurement, and anything else but authentication an application's.
+func classify(kind connKind, name string, doc bson.Raw, exhaust, polling bool) connKind {
+	if kind != kindUnknown {
+		return kind
+	}
+
+	switch {
+	case isAuthCommand(name):
+		return kindUnknown
+	case isHello(name) && (exhaust || isStreamingHello(doc)):
+		return kindMonitoring
+	case isHello(name) && polling:
+		return kindMonitoring
+	case isHello(name):
+		return kindRTT
+	default:
+		return kindPool
+	}
+}
+
+// isStreamingHello reports whether a hello asks the server to wait for a
+// topology change before answering.
+func isStreamingHello(doc bson.Raw) bool {
+	_, tvErr := doc.LookupErr("topologyVersion")
+	_, waitErr := doc.LookupErr("maxAwaitTimeMS")
+	return tvErr == nil && waitErr == nil
+}
@@ -0,0 +1,37 @@
+package mongoproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestClassify(t *testing.T) {
+	hello := marshalDoc(t, bson.D{{Key: "hello", Value: 1}})
+	streaming := marshalDoc(t, bson.D{
+		{Key: "hello", Value: 1},
+		{Key: "topologyVersion", Value: bson.D{{Key: "processId", Value: bson.NewObjectID()}, {Key: "counter", Value: int64(0)}}},
+		{Key: "maxAwaitTimeMS", Value: int64(10000)},
+	})
+	find := marshalDoc(t, bson.D{{Key: "find", Value: "coll"}})
+
+	require.Equal(t, kindMonitoring, classify(kindUnknown, "hello", streaming, false, false))
+	require.Equal(t, kindRTT, classify(kindUnknown, "isMaster", hello, false, false))
+	require.Equal(t, kindPool, classify(kindUnknown, "find", find, false, false))
+	require.Equal(t, kindUnknown, classify(kindUnknown, "saslStart", nil, false, false), "authentication does not tell")
+
+	require.Equal(t, kindMonitoring, classify(kindUnknown, "hello", hello, true, false), "exhaustAllowed streams")
+	require.Equal(t, kindMonitoring, classify(kindUnknown, "isMaster", hello, false, true), "only monitors poll a server that does not stream")
+	require.Equal(t, kindPool, classify(kindUnknown, "find", find, false, true))
+
+	require.Equal(t, kindMonitoring, classify(kindMonitoring, "hello", hello, false, false), "the first telling command decides")
+	require.Equal(t, kindPool, classify(kindPool, "hello", streaming, false, false))
+}
+
+func TestConnKindString(t *testing.T) {
+	require.Equal(t, "", kindUnknown.String())
+	require.Equal(t, "monitoring", kindMonitoring.String())
+	require.Equal(t, "rtt", kindRTT.String())
+	require.Equal(t, "pool", kindPool.String())
+}
@@ -0,0 +1,197 @@
+package mongoproxy
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnectionInfo describes an open proxied connection.
+type ConnectionInfo struct {
+	ID         int64          `json:"id" bson:"id"`
+	ClientAddr string         `json:"clientAddr" bson:"clientAddr"`
+	ServerAddr string         `json:"serverAddr" bson:"serverAddr"`
+	Since      time.Time      `json:"since" bson:"since"`
+	Client     ClientMetadata `json:"client" bson:"client"`                 // from the handshake, once there has been one
+	Kind       string         `json:"kind,omitempty" bson:"kind,omitempty"` // "monitoring", "rtt" or "pool", once known
+}
+
+// ConnFilter selects connections. Empty fields match every connection.
+type ConnFilter struct {
+	AppName    string // client.application.name from the handshake
+	RemoteAddr string // client address, as host:port or just host
+	Kind       string // "monitoring", "rtt" or "pool"
+}
+
+// Connections returns the open connections, in accept order.
+func (p *Proxy) Connections() []ConnectionInfo {
+	conns := p.conns.list()
+
+	infos := make([]ConnectionInfo, len(conns))
+	for i, pc := range conns {
+		infos[i] = pc.info()
+	}
+	return infos
+}
+
+// CloseConnections closes the connections matching f, both the client and
+// the server side, and returns how many there were.
+func (p *Proxy) CloseConnections(f ConnFilter) int {
+	n := 0
+	for _, pc := range p.conns.list() {
+		if f.matches(pc.info()) {
+			pc.close()
+			n++
+		}
+	}
+	return n
+}
+
+// Freeze stops reading from both sides of every connection, new ones
+// included, until Resume. Clients see a server that accepts connections but
+// never answers.
+func (p *Proxy) Freeze() {
+	p.frozen.close()
+}
+
+// Resume lets traffic flow again after Freeze.
+func (p *Proxy) Resume() {
+	p.frozen.open()
+}
+
+// matches reports whether the connection described by info is selected by f.
+func (f ConnFilter) matches(info ConnectionInfo) bool {
+	if f.AppName != "" && f.AppName != info.Client.AppName {
+		return false
+	}
+
+	if f.Kind != "" && f.Kind != info.Kind {
+		return false
+	}
+
+	if f.RemoteAddr != "" && f.RemoteAddr != info.ClientAddr {
+		host, _, err := net.SplitHostPort(info.ClientAddr)
+		if err != nil || host != f.RemoteAddr {
+			return false
+		}
+	}
+
+	return true
+}
+
+// info describes the connection.
+func (pc *proxyConn) info() ConnectionInfo {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return ConnectionInfo{
+		ID:         pc.id,
+		ClientAddr: pc.client.RemoteAddr().String(),
+		ServerAddr: pc.server.RemoteAddr().String(),
+		Since:      pc.since,
+		Client:     pc.meta,
+		Kind:       pc.kind.String(),
+	}
+}
+
+// connSet tracks a proxy's open connections. The zero value is ready to use.
+type connSet struct {
+	mu    sync.Mutex
+	conns map[int64]*proxyConn
+}
+
+// add starts tracking pc.
+func (cs *connSet) add(pc *proxyConn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.conns == nil {
+		cs.conns = make(map[int64]*proxyConn)
+	}
+	cs.conns[pc.id] = pc
+}
+
+// remove stops tracking the connection with the given ID.
+func (cs *connSet) remove(id int64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	delete(cs.conns, id)
+}
+
+// list returns the open connections in accept order.
+func (cs *connSet) list() []*proxyConn {
+	cs.mu.Lock()
+	conns := make([]*proxyConn, 0, len(cs.conns))
+	for _, pc := range cs.conns {
+		conns = append(conns, pc)
+	}
+	cs.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+	return conns
+}
+
+// closeAll closes every open connection and returns how many there were.
+func (cs *connSet) closeAll() int {
+	conns := cs.list()
+	for _, pc := range conns {
+		pc.close()
+	}
+	return len(conns)
+}
+
+// closed reports whether the gate is closed.
+func (g *gate) closed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.opened != nil
+}
+
+// gate holds traffic back while it is closed. The zero value is open.
+type gate struct {
+	mu     sync.Mutex
+	opened chan struct{} // non-nil while closed; closed when the gate opens
+}
+
+// close closes the gate, if it is open.
+func (g *gate) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.opened == nil {
+		g.opened = make(chan struct{})
+	}
+}
+
+// open opens the gate, letting everything waiting on it through.
+func (g *gate) open() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.opened != nil {
+		close(g.opened)
+		g.opened = nil
+	}
+}
+
+// wait blocks while the gate is closed. It reports whether the gate opened
+// before ctx was done.
+func (g *gate) wait(ctx context.Context) bool {
+	g.mu.Lock()
+	opened := g.opened
+	g.mu.Unlock()
+
+	if opened == nil {
+		return true
+	}
+
+	select {
+	case <-opened:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
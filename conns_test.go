@@ -0,0 +1,122 @@
+package mongoproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// addTestConn registers a connection whose client address is addr, and
+// returns the client's end of it.
+func addTestConn(t *testing.T, p *Proxy, id int64, addr string) net.Conn {
+	t.Helper()
+
+	client, peer := net.Pipe()
+	server, _ := net.Pipe()
+	pc := &proxyConn{id: id, client: addrConn{client, addr}, server: server}
+	p.conns.add(pc)
+	return peer
+}
+
+// addrConn is a net.Conn with a given remote address.
+type addrConn struct {
+	net.Conn
+	addr string
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
+
+func TestConnFilterMatches(t *testing.T) {
+	info := ConnectionInfo{ClientAddr: "10.0.0.1:5000", Client: ClientMetadata{AppName: "reports"}, Kind: "pool"}
+
+	require.True(t, ConnFilter{}.matches(info))
+	require.True(t, ConnFilter{AppName: "reports"}.matches(info))
+	require.True(t, ConnFilter{RemoteAddr: "10.0.0.1"}.matches(info))
+	require.True(t, ConnFilter{RemoteAddr: "10.0.0.1:5000", AppName: "reports"}.matches(info))
+
+	require.False(t, ConnFilter{AppName: "billing"}.matches(info))
+	require.False(t, ConnFilter{RemoteAddr: "10.0.0.1:5001"}.matches(info))
+	require.False(t, ConnFilter{RemoteAddr: "10.0.0.1", AppName: "billing"}.matches(info))
+
+	require.True(t, ConnFilter{Kind: "pool"}.matches(info))
+	require.False(t, ConnFilter{Kind: "monitoring"}.matches(info))
+}
+
+func TestProxyCloseConnections(t *testing.T) {
+	p := &Proxy{ctx: context.Background()}
+
+	first := addTestConn(t, p, 1, "10.0.0.1:5000")
+	second := addTestConn(t, p, 2, "10.0.0.2:5000")
+
+	conns := p.Connections()
+	require.Len(t, conns, 2)
+	require.Equal(t, int64(1), conns[0].ID)
+	require.Equal(t, "10.0.0.2:5000", conns[1].ClientAddr)
+
+	require.Equal(t, 0, p.CloseConnections(ConnFilter{RemoteAddr: "10.0.0.3"}))
+	require.Equal(t, 1, p.CloseConnections(ConnFilter{RemoteAddr: "10.0.0.2"}))
+
+	_, err := second.Read(make([]byte, 1))
+	require.Error(t, err, "the matching connection should be closed")
+
+	require.Equal(t, 2, p.CloseConnections(ConnFilter{}), "closed connections stay listed until their goroutines exit")
+
+	_, err = first.Read(make([]byte, 1))
+	require.Error(t, err)
+}
+
+func TestProxyConnObserve(t *testing.T) {
+	client, _ := net.Pipe()
+	pc := &proxyConn{p: &Proxy{stats: newMetrics()}, id: 1, client: addrConn{client, "10.0.0.1:5000"}}
+
+	first, err := bson.Marshal(bson.D{
+		{Key: "hello", Value: 1},
+		{Key: "client", Value: bson.D{{Key: "application", Value: bson.D{{Key: "name", Value: "reports"}}}}},
+	})
+	require.NoError(t, err)
+	pc.observe("hello", first, false)
+
+	later, err := bson.Marshal(bson.D{{Key: "hello", Value: 1}})
+	require.NoError(t, err)
+	_, kind := pc.observe("hello", later, false)
+	require.Equal(t, kindRTT, kind)
+
+	meta, ok := pc.clientMetadata()
+	require.True(t, ok)
+	require.Equal(t, "reports", meta.AppName, "only the handshake carries client metadata")
+}
+
+func TestProxyFreeze(t *testing.T) {
+	p := &Proxy{ctx: context.Background()}
+	require.True(t, p.frozen.wait(context.Background()))
+
+	p.Freeze()
+	p.Freeze()
+
+	passed := make(chan bool)
+	go func() {
+		passed <- p.frozen.wait(context.Background())
+	}()
+
+	select {
+	case <-passed:
+		t.Fatal("traffic should not flow while frozen")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.Resume()
+	require.True(t, <-passed)
+	p.Resume()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.Freeze()
+	cancel()
+	require.False(t, p.frozen.wait(ctx), "closed connections should stop waiting")
+}
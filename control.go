@@ -0,0 +1,171 @@
+package mongoproxy
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Control commands are answered by the proxy itself when sent to the admin
+// database, so tests in any language can drive it with runCommand.
+const (
+	cmdProxyStatus = "proxyStatus" // {proxyStatus: 1}: connections, rules, faults and network state
+	cmdProxyArm    = "proxyArm"    // {proxyArm: rule or [rules]}: arm rules
+	cmdProxyReset  = "proxyReset"  // {proxyReset: 1}: back to plain forwarding
+)
+
+// isControlCommand reports whether the command is one the proxy answers
+// itself.
+func isControlCommand(name string, doc bson.Raw) bool {
+	switch name {
+	case cmdProxyStatus, cmdProxyArm, cmdProxyReset:
+	default:
+		return false
+	}
+
+	db, _ := doc.Lookup("$db").StringValueOK()
+	return db == "admin"
+}
+
+// control answers the control command in info.
+func (p *Proxy) control(info commandInfo) bson.Raw {
+	switch info.name {
+	case cmdProxyStatus:
+		return p.statusDocument()
+
+	case cmdProxyArm:
+		rules, err := parseArm(info.doc.Lookup(cmdProxyArm))
+		if err != nil {
+			return (&errorReply{Code: 2, CodeName: "BadValue", Errmsg: err.Error()}).document(nil)
+		}
+		for _, r := range rules {
+			p.rules.arm(r, info)
+		}
+		log.Printf("Armed %d rules from connection #%d", len(rules), info.connID)
+		return controlReply(bson.E{Key: "armed", Value: len(rules)})
+
+	default:
+		n := p.Reset()
+		return controlReply(bson.E{Key: "disarmed", Value: n})
+	}
+}
+
+// parseArm decodes the rules of a proxyArm command: one rule document or an
+// array of them.
+func parseArm(v bson.RawValue) ([]rule, error) {
+	if doc, ok := v.DocumentOK(); ok {
+		var r rule
+		if err := decodeStrict(doc, &r, cmdProxyArm); err != nil {
+			return nil, err
+		}
+		if err := r.validate(cmdProxyArm); err != nil {
+			return nil, err
+		}
+		return []rule{r}, nil
+	}
+
+	arr, ok := v.ArrayOK()
+	if !ok {
+		return nil, fmt.Errorf("proxyArm must be a rule document or an array of them")
+	}
+
+	values, err := arr.Values()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+
+	rules := make([]rule, len(values))
+	for i, value := range values {
+		path := fmt.Sprintf("%s[%d]", cmdProxyArm, i)
+
+		doc, ok := value.DocumentOK()
+		if !ok {
+			return nil, fmt.Errorf("%s: must be a document, not %s", path, value.Type)
+		}
+		if err := decodeStrict(doc, &rules[i], path); err != nil {
+			return nil, err
+		}
+		if err := rules[i].validate(path); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// statusDocument describes the proxy's state, for proxyStatus and the admin
+// API.
+func (p *Proxy) statusDocument() bson.Raw {
+	return controlReply(
+		bson.E{Key: "connections", Value: p.Connections()},
+		bson.E{Key: "rules", Value: p.rules.list()},
+		bson.E{Key: "faults", Value: p.faults.snapshot()},
+		bson.E{Key: "barriers", Value: p.barriers.all()},
+		bson.E{Key: "network", Value: p.network.current().String()},
+		bson.E{Key: "frozen", Value: p.frozen.closed()},
+	)
+}
+
+// controlReply builds a successful reply with the given fields.
+func controlReply(fields ...bson.E) bson.Raw {
+	raw, err := bson.Marshal(append(bson.D(fields), bson.E{Key: "ok", Value: 1.0}))
+	if err != nil {
+		// Every value passed in is marshalable.
+		panic(fmt.Sprintf("failed to marshal control reply: %v", err))
+	}
+	return raw
+}
+
+// Reset returns the proxy to plain forwarding: it disarms every rule,
+// releases every parked message, heals the network, resumes traffic and
+// zeroes the fault counters of proxyStatus. It returns how many rules were
+// disarmed.
+func (p *Proxy) Reset() int {
+	n := p.rules.reset()
+	for name := range p.barriers.all() {
+		p.barriers.releaseAll(name)
+	}
+	p.Heal()
+	p.Resume()
+	p.faults.reset()
+
+	log.Printf("Proxy reset, %d rules disarmed", n)
+	return n
+}
+
+// faultCounter counts the actions a proxy has applied, by type. The zero
+// value is ready to use.
+type faultCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (fc *faultCounter) inc(actionType string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if fc.counts == nil {
+		fc.counts = make(map[string]int64)
+	}
+	fc.counts[actionType]++
+}
+
+// snapshot returns a copy of the counts.
+func (fc *faultCounter) snapshot() map[string]int64 {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	counts := make(map[string]int64, len(fc.counts))
+	for k, v := range fc.counts {
+		counts[k] = v
+	}
+	return counts
+}
+
+func (fc *faultCounter) reset() {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.counts = nil
+}
@@ -0,0 +1,97 @@
+package mongoproxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestIsControlCommand(t *testing.T) {
+	admin := marshalDoc(t, bson.D{{Key: "proxyStatus", Value: 1}, {Key: "$db", Value: "admin"}})
+	other := marshalDoc(t, bson.D{{Key: "proxyStatus", Value: 1}, {Key: "$db", Value: "test"}})
+	ping := marshalDoc(t, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}})
+
+	require.True(t, isControlCommand("proxyStatus", admin))
+	require.False(t, isControlCommand("proxyStatus", other), "only the admin database is intercepted")
+	require.False(t, isControlCommand("ping", ping))
+}
+
+func TestControlArm(t *testing.T) {
+	p := &Proxy{ctx: context.Background()}
+
+	one := marshalDoc(t, bson.D{
+		{Key: "proxyArm", Value: bson.D{
+			{Key: "match", Value: bson.D{{Key: "command", Value: "find"}}},
+			{Key: "actions", Value: bson.A{bson.D{{Key: "error", Value: bson.D{{Key: "code", Value: 91}}}}}},
+		}},
+		{Key: "$db", Value: "admin"},
+	})
+	reply := p.control(commandInfo{name: "proxyArm", doc: one})
+	require.Equal(t, 1.0, reply.Lookup("ok").Double())
+	require.EqualValues(t, 1, reply.Lookup("armed").AsInt64())
+
+	many := marshalDoc(t, bson.D{
+		{Key: "proxyArm", Value: bson.A{
+			bson.D{
+				{Key: "match", Value: bson.D{{Key: "command", Value: "insert"}}},
+				{Key: "actions", Value: bson.A{bson.D{{Key: "delayMs", Value: 10}}}},
+			},
+			bson.D{
+				{Key: "match", Value: bson.D{{Key: "command", Value: "update"}}},
+				{Key: "actions", Value: bson.A{bson.D{{Key: "delayMs", Value: 10}}}},
+			},
+		}},
+		{Key: "$db", Value: "admin"},
+	})
+	reply = p.control(commandInfo{name: "proxyArm", doc: many})
+	require.EqualValues(t, 2, reply.Lookup("armed").AsInt64())
+	require.NotNil(t, p.rules.match(commandInfo{name: "find"}))
+
+	bad := marshalDoc(t, bson.D{{Key: "proxyArm", Value: 1}, {Key: "$db", Value: "admin"}})
+	reply = p.control(commandInfo{name: "proxyArm", doc: bad})
+	require.Equal(t, 0.0, reply.Lookup("ok").Double())
+	require.EqualValues(t, 2, reply.Lookup("code").AsInt64())
+
+	typo := marshalDoc(t, bson.D{
+		{Key: "proxyArm", Value: bson.A{bson.D{{Key: "match", Value: bson.D{{Key: "cmd", Value: "find"}}}}}},
+		{Key: "$db", Value: "admin"},
+	})
+	reply = p.control(commandInfo{name: "proxyArm", doc: typo})
+	require.Equal(t, 0.0, reply.Lookup("ok").Double())
+	require.Contains(t, reply.Lookup("errmsg").StringValue(), "proxyArm[0].match.cmd: unknown field")
+
+	empty := marshalDoc(t, bson.D{
+		{Key: "proxyArm", Value: bson.D{{Key: "match", Value: bson.D{{Key: "command", Value: "find"}}}}},
+		{Key: "$db", Value: "admin"},
+	})
+	reply = p.control(commandInfo{name: "proxyArm", doc: empty})
+	require.Equal(t, 0.0, reply.Lookup("ok").Double())
+	require.Contains(t, reply.Lookup("errmsg").StringValue(), "proxyArm.actions: at least one is required")
+}
+
+func TestControlStatusAndReset(t *testing.T) {
+	p := &Proxy{ctx: context.Background()}
+	addTestConn(t, p, 1, "10.0.0.1:5000")
+
+	p.rules.arm(rule{Match: ruleMatch{Command: ptr("find")}, Times: ptr(-1)}, commandInfo{})
+	p.faults.inc("error")
+	p.Freeze()
+
+	status := p.control(commandInfo{name: "proxyStatus"})
+	require.Equal(t, 1.0, status.Lookup("ok").Double())
+	require.Equal(t, "10.0.0.1:5000", status.Lookup("connections", "0", "clientAddr").StringValue())
+	require.Equal(t, "find", status.Lookup("rules", "0", "match", "command").StringValue())
+	require.EqualValues(t, -1, status.Lookup("rules", "0", "remaining").AsInt64())
+	require.EqualValues(t, 1, status.Lookup("faults", "error").AsInt64())
+	require.Equal(t, "healthy", status.Lookup("network").StringValue())
+	require.True(t, status.Lookup("frozen").Boolean())
+
+	reply := p.control(commandInfo{name: "proxyReset"})
+	require.EqualValues(t, 1, reply.Lookup("disarmed").AsInt64())
+
+	require.Empty(t, p.rules.list())
+	require.Empty(t, p.faults.snapshot())
+	require.False(t, p.frozen.closed())
+}
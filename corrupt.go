@@ -0,0 +1,131 @@
+package mongoproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/x/mongo/driver/wiremessage"
+)
+
+// corruption describes byte-level damage to a reply, for testing how clients
+// cope with malformed wire messages.
+type corruption struct {
+	Seed           *int64 `bson:"seed,omitempty"`           // seed for flipBits; random if unset
+	FlipBits       int    `bson:"flipBits,omitempty"`       // random bits to flip in the body document
+	LengthDelta    int32  `bson:"lengthDelta,omitempty"`    // added to the header's messageLength
+	Opcode         *int32 `bson:"opcode,omitempty"`         // replaces the header's opCode
+	ResponseTo     *int32 `bson:"responseTo,omitempty"`     // replaces the header's responseTo
+	DocLengthDelta int32  `bson:"docLengthDelta,omitempty"` // added to the body document's length
+}
+
+// String lists the kinds of damage, e.g. "flipBits=3,opcode=2004".
+func (c *corruption) String() string {
+	var parts []string
+	if c.FlipBits > 0 {
+		parts = append(parts, fmt.Sprintf("flipBits=%d", c.FlipBits))
+	}
+	if c.LengthDelta != 0 {
+		parts = append(parts, fmt.Sprintf("lengthDelta=%d", c.LengthDelta))
+	}
+	if c.Opcode != nil {
+		parts = append(parts, fmt.Sprintf("opcode=%d", *c.Opcode))
+	}
+	if c.ResponseTo != nil {
+		parts = append(parts, fmt.Sprintf("responseTo=%d", *c.ResponseTo))
+	}
+	if c.DocLengthDelta != 0 {
+		parts = append(parts, fmt.Sprintf("docLengthDelta=%d", c.DocLengthDelta))
+	}
+	return strings.Join(parts, ",")
+}
+
+// apply returns a corrupted copy of the wire message buf. Bit flips use the
+// given seed, so a failure can be replayed.
+func (c *corruption) apply(buf []byte, seed int64) []byte {
+	out := append([]byte(nil), buf...)
+	if len(out) < 16 {
+		return out
+	}
+
+	if offset, ok := bodyOffset(out); ok {
+		size := int(binary.LittleEndian.Uint32(out[offset:]))
+		end := min(offset+size, len(out))
+
+		rng := rand.New(rand.NewSource(seed))
+		for i := 0; i < c.FlipBits; i++ {
+			// Leave the document's own length alone so the damage lands in
+			// its elements.
+			pos := offset + 4 + rng.Intn(max(end-offset-4, 1))
+			if pos < len(out) {
+				out[pos] ^= 1 << rng.Intn(8)
+			}
+		}
+
+		if c.DocLengthDelta != 0 {
+			binary.LittleEndian.PutUint32(out[offset:], uint32(int32(size)+c.DocLengthDelta))
+		}
+	}
+
+	if c.LengthDelta != 0 {
+		length := int32(binary.LittleEndian.Uint32(out[0:]))
+		binary.LittleEndian.PutUint32(out[0:], uint32(length+c.LengthDelta))
+	}
+	if c.ResponseTo != nil {
+		binary.LittleEndian.PutUint32(out[8:], uint32(*c.ResponseTo))
+	}
+	if c.Opcode != nil {
+		binary.LittleEndian.PutUint32(out[12:], uint32(*c.Opcode))
+	}
+
+	return out
+}
+
+// bodyOffset returns where the body document of an OP_MSG or OP_REPLY wire
+// message starts.
+func bodyOffset(raw []byte) (int, bool) {
+	_, _, _, opcode, body, ok := wiremessage.ReadHeader(raw)
+	if !ok {
+		return 0, false
+	}
+
+	switch opcode {
+	case wiremessage.OpReply:
+		// flags, cursorID, startingFrom and numberReturned
+		offset := 16 + 4 + 8 + 4 + 4
+		return offset, len(raw) >= offset+4
+
+	case wiremessage.OpMsg:
+		offset := 16 + 4
+		_, body, ok = wiremessage.ReadMsgFlags(body)
+		if !ok {
+			return 0, false
+		}
+
+		for len(body) > 0 {
+			var stype wiremessage.SectionType
+			stype, body, ok = wiremessage.ReadMsgSectionType(body)
+			if !ok {
+				return 0, false
+			}
+			offset++
+
+			if len(body) < 4 {
+				return 0, false
+			}
+			size := int(binary.LittleEndian.Uint32(body))
+			if size < 4 || size > len(body) {
+				return 0, false
+			}
+
+			if stype == wiremessage.SingleDocument {
+				return offset, true
+			}
+			body = body[size:]
+			offset += size
+		}
+	}
+
+	return 0, false
+}
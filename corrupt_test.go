@@ -0,0 +1,58 @@
+package mongoproxy
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestBodyOffset(t *testing.T) {
+	body := bson.D{{Key: "ok", Value: 1.0}}
+	doc := marshalDoc(t, body)
+
+	msg := buildOpMsg(t, 1, 2, body, bson.D{{Key: "_id", Value: 1}})
+	offset, ok := bodyOffset(msg)
+	require.True(t, ok)
+	require.Equal(t, []byte(doc), msg[offset:offset+len(doc)])
+
+	reply := buildOpReply(t, 2, body)
+	offset, ok = bodyOffset(reply)
+	require.True(t, ok)
+	require.Equal(t, []byte(doc), reply[offset:offset+len(doc)])
+}
+
+func TestCorruptionFlipBits(t *testing.T) {
+	msg := buildOpMsg(t, 1, 2, bson.D{{Key: "cursor", Value: bson.D{{Key: "id", Value: int64(0)}}}, {Key: "ok", Value: 1.0}})
+	c := &corruption{FlipBits: 4}
+
+	first := c.apply(msg, 42)
+	require.NotEqual(t, msg, first)
+	require.Equal(t, msg[:16], first[:16], "header should be intact")
+	require.Equal(t, first, c.apply(msg, 42), "the same seed should corrupt the same bits")
+	require.NotEqual(t, first, c.apply(msg, 43))
+}
+
+func TestCorruptionHeader(t *testing.T) {
+	msg := buildOpMsg(t, 1, 2, bson.D{{Key: "ok", Value: 1.0}})
+	c := &corruption{
+		LengthDelta:    100,
+		Opcode:         ptr(int32(2004)),
+		ResponseTo:     ptr(int32(99)),
+		DocLengthDelta: -1,
+	}
+
+	out := c.apply(msg, 0)
+	require.Equal(t, int32(len(msg)+100), int32(binary.LittleEndian.Uint32(out[0:])))
+	require.Equal(t, int32(99), int32(binary.LittleEndian.Uint32(out[8:])))
+	require.Equal(t, int32(2004), int32(binary.LittleEndian.Uint32(out[12:])))
+
+	offset, ok := bodyOffset(msg)
+	require.True(t, ok)
+	require.Equal(t,
+		binary.LittleEndian.Uint32(msg[offset:])-1,
+		binary.LittleEndian.Uint32(out[offset:]),
+	)
+	require.Equal(t, "lengthDelta=100,opcode=2004,responseTo=99,docLengthDelta=-1", c.String())
+}
@@ -0,0 +1,334 @@
+package mongoproxy
+
+import (
+	"fmt"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// syntheticCursorBase is the first ID handed out for cursors that the server
+// has already exhausted but that still have documents held back by
+// splitBatch.
+const syntheticCursorBase = int64(0x7ff0_0000_0000_0000)
+
+// cursorState is what the proxy knows about a cursor.
+type cursorState struct {
+	ns           string
+	connID       int64 // connection that last used the cursor
+	changeStream bool  // opened by an aggregate with $changeStream
+	getMores     int   // getMore commands seen
+	docs         int   // documents returned by the server so far
+
+	buffered  []bson.Raw // documents held back by splitBatch
+	batchSize int        // size of the batches buffered documents are served in
+	exhausted bool       // the server cursor is closed; buffered documents are the last
+}
+
+// cursorTracker follows every cursor opened through a proxy. A cursor can be
+// continued on any connection, so it is shared by all of them, but it is
+// forgotten once the last connection to use it closes. The zero value is
+// ready to use.
+type cursorTracker struct {
+	mu            sync.Mutex
+	cursors       map[int64]*cursorState
+	nextSynthetic int64
+}
+
+// cursorReply is the cursor document of a find, aggregate or getMore reply.
+type cursorReply struct {
+	ID         int64      `bson:"id"`
+	NS         string     `bson:"ns"`
+	FirstBatch []bson.Raw `bson:"firstBatch"`
+	NextBatch  []bson.Raw `bson:"nextBatch"`
+}
+
+// parseCursorReply returns the cursor in a reply, if it has one.
+func parseCursorReply(reply bson.Raw) (cursorReply, bool) {
+	raw, ok := reply.Lookup("cursor").DocumentOK()
+	if !ok {
+		return cursorReply{}, false
+	}
+
+	var cr cursorReply
+	if err := bson.Unmarshal(raw, &cr); err != nil {
+		return cursorReply{}, false
+	}
+	return cr, true
+}
+
+// batch returns whichever batch the reply carries.
+func (cr cursorReply) batch() []bson.Raw {
+	if cr.FirstBatch != nil {
+		return cr.FirstBatch
+	}
+	return cr.NextBatch
+}
+
+// get returns the state for id, creating it if needed. The caller must hold
+// ct.mu.
+func (ct *cursorTracker) get(id int64) *cursorState {
+	if ct.cursors == nil {
+		ct.cursors = make(map[int64]*cursorState)
+	}
+
+	c, ok := ct.cursors[id]
+	if !ok {
+		c = &cursorState{}
+		ct.cursors[id] = c
+	}
+	return c
+}
+
+// startGetMore counts a getMore on cursor id in info, recording its position
+// and whether the cursor is a change stream.
+func (ct *cursorTracker) startGetMore(info *commandInfo) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	c := ct.get(info.cursorID)
+	c.connID = info.connID
+	c.getMores++
+	info.getMoreN = c.getMores
+	info.changeStream = c.changeStream
+}
+
+// observeReply records the batch in the reply to the command in info. For a
+// getMore, info.cursorID is the cursor asked for, since the server reports ID
+// 0 once a cursor is exhausted. It returns the cursor ID and how many
+// documents the server had returned before this batch.
+func (ct *cursorTracker) observeReply(reply bson.Raw, info commandInfo) (id int64, docsBefore int, batchLen int, ok bool) {
+	cr, ok := parseCursorReply(reply)
+	if !ok {
+		return 0, 0, 0, false
+	}
+
+	batchLen = len(cr.batch())
+
+	id = cr.ID
+	if id == 0 {
+		id = info.cursorID
+	}
+	if id == 0 {
+		return 0, 0, batchLen, true
+	}
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	c := ct.get(id)
+	c.ns = cr.NS
+	c.connID = info.connID
+	c.changeStream = c.changeStream || info.changeStream
+	docsBefore = c.docs
+	c.docs += batchLen
+
+	if cr.ID == 0 && len(c.buffered) == 0 {
+		delete(ct.cursors, id)
+	}
+
+	return id, docsBefore, batchLen, true
+}
+
+// closeConn forgets the cursors last used by the given connection, which has
+// closed. A driver that continues one on another connection is answered by
+// the server alone, without documents split off by splitBatch.
+func (ct *cursorTracker) closeConn(connID int64) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	for id, c := range ct.cursors {
+		if c.connID == connID {
+			delete(ct.cursors, id)
+		}
+	}
+}
+
+// forget drops the state of the given cursors, e.g. after killCursors.
+func (ct *cursorTracker) forget(ids ...int64) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	for _, id := range ids {
+		delete(ct.cursors, id)
+	}
+}
+
+// split keeps the first n documents of the reply's batch and holds the rest
+// back, to be served n at a time by bufferedReply. If the server has already
+// closed the cursor, the client is given a synthetic cursor ID to fetch the
+// rest with. connID is the connection the reply is for.
+func (ct *cursorTracker) split(reply bson.Raw, n int, connID int64) (bson.Raw, error) {
+	cr, ok := parseCursorReply(reply)
+	if !ok {
+		return nil, fmt.Errorf("reply has no cursor")
+	}
+
+	batch := cr.batch()
+	if n < 1 || len(batch) <= n {
+		return reply, nil
+	}
+
+	ct.mu.Lock()
+	id := cr.ID
+	exhausted := id == 0
+	if exhausted {
+		id = syntheticCursorBase + ct.nextSynthetic
+		ct.nextSynthetic++
+	}
+
+	c := ct.get(id)
+	c.ns = cr.NS
+	c.connID = connID
+	c.buffered = append(append([]bson.Raw(nil), batch[n:]...), c.buffered...)
+	c.batchSize = n
+	c.exhausted = exhausted
+	ct.mu.Unlock()
+
+	batchKey := "nextBatch"
+	if cr.FirstBatch != nil {
+		batchKey = "firstBatch"
+	}
+
+	return rewriteCursor(reply, batchKey, batch[:n], id)
+}
+
+// bufferedReply answers a getMore on cursor id from the documents held back
+// by split, if there are any.
+func (ct *cursorTracker) bufferedReply(id int64) (bson.Raw, bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	c, ok := ct.cursors[id]
+	if !ok || len(c.buffered) == 0 {
+		return nil, false
+	}
+
+	n := min(c.batchSize, len(c.buffered))
+	batch := c.buffered[:n]
+	c.buffered = c.buffered[n:]
+
+	replyID := id
+	if len(c.buffered) == 0 && c.exhausted {
+		replyID = 0
+		delete(ct.cursors, id)
+	}
+
+	reply, err := bson.Marshal(bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "nextBatch", Value: batch},
+			{Key: "id", Value: replyID},
+			{Key: "ns", Value: c.ns},
+		}},
+		{Key: "ok", Value: 1.0},
+	})
+	if err != nil {
+		return nil, false
+	}
+	return reply, true
+}
+
+// cursorIDs returns the cursor IDs named by a killCursors command.
+func cursorIDs(killCursors bson.Raw) []int64 {
+	arr, ok := killCursors.Lookup("cursors").ArrayOK()
+	if !ok {
+		return nil
+	}
+
+	values, err := arr.Values()
+	if err != nil {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(values))
+	for _, v := range values {
+		if id, ok := v.AsInt64OK(); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// isChangeStream reports whether cmd is an aggregate that opens a change
+// stream.
+func isChangeStream(cmd bson.Raw) bool {
+	pipeline, ok := cmd.Lookup("pipeline").ArrayOK()
+	if !ok {
+		return false
+	}
+
+	first, err := pipeline.IndexErr(0)
+	if err != nil {
+		return false
+	}
+
+	stage, ok := first.DocumentOK()
+	if !ok {
+		return false
+	}
+
+	_, err = stage.LookupErr("$changeStream")
+	return err == nil
+}
+
+// removeCursorField returns reply without the given field of its cursor
+// document, such as postBatchResumeToken.
+func removeCursorField(reply bson.Raw, key string) (bson.Raw, error) {
+	var doc bson.D
+	if err := bson.Unmarshal(reply, &doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reply: %w", err)
+	}
+
+	for i, elem := range doc {
+		if elem.Key != "cursor" {
+			continue
+		}
+
+		cursor, ok := elem.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("cursor is a %T, not a document", elem.Value)
+		}
+
+		kept := cursor[:0]
+		for _, field := range cursor {
+			if field.Key != key {
+				kept = append(kept, field)
+			}
+		}
+		doc[i].Value = kept
+	}
+
+	return bson.Marshal(doc)
+}
+
+// rewriteCursor replaces the batch and ID of the cursor in reply, keeping
+// every other field.
+func rewriteCursor(reply bson.Raw, batchKey string, batch []bson.Raw, id int64) (bson.Raw, error) {
+	var doc bson.D
+	if err := bson.Unmarshal(reply, &doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reply: %w", err)
+	}
+
+	for i, elem := range doc {
+		if elem.Key != "cursor" {
+			continue
+		}
+
+		cursor, ok := elem.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("cursor is a %T, not a document", elem.Value)
+		}
+
+		for j := range cursor {
+			switch cursor[j].Key {
+			case batchKey:
+				cursor[j].Value = batch
+			case "id":
+				cursor[j].Value = id
+			}
+		}
+		doc[i].Value = cursor
+	}
+
+	return bson.Marshal(doc)
+}
@@ -0,0 +1,243 @@
+package mongoproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func marshalDoc(t *testing.T, doc bson.D) bson.Raw {
+	t.Helper()
+
+	raw, err := bson.Marshal(doc)
+	require.NoError(t, err)
+	return raw
+}
+
+func cursorReplyDoc(t *testing.T, batchKey string, id int64, n, from int) bson.Raw {
+	t.Helper()
+
+	batch := make(bson.A, n)
+	for i := range batch {
+		batch[i] = bson.D{{Key: "_id", Value: int32(from + i)}}
+	}
+
+	reply, err := bson.Marshal(bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: batchKey, Value: batch},
+			{Key: "id", Value: id},
+			{Key: "ns", Value: "test.coll"},
+		}},
+		{Key: "ok", Value: 1.0},
+	})
+	require.NoError(t, err)
+	return reply
+}
+
+func batchIDs(t *testing.T, reply bson.Raw) ([]int32, int64) {
+	t.Helper()
+
+	cr, ok := parseCursorReply(reply)
+	require.True(t, ok)
+
+	var ids []int32
+	for _, doc := range cr.batch() {
+		ids = append(ids, doc.Lookup("_id").Int32())
+	}
+	return ids, cr.ID
+}
+
+func TestCursorTrackerObserveReply(t *testing.T) {
+	var ct cursorTracker
+
+	id, before, n, ok := ct.observeReply(cursorReplyDoc(t, "firstBatch", 42, 3, 0), commandInfo{name: "find"})
+	require.True(t, ok)
+	require.Equal(t, int64(42), id)
+	require.Equal(t, 0, before)
+	require.Equal(t, 3, n)
+
+	getMore := commandInfo{name: "getMore", cursorID: 42}
+	ct.startGetMore(&getMore)
+	require.Equal(t, 1, getMore.getMoreN)
+
+	// The server reports ID 0 once the cursor is exhausted.
+	id, before, n, ok = ct.observeReply(cursorReplyDoc(t, "nextBatch", 0, 2, 3), getMore)
+	require.True(t, ok)
+	require.Equal(t, int64(42), id)
+	require.Equal(t, 3, before)
+	require.Equal(t, 2, n)
+	require.Empty(t, ct.cursors, "exhausted cursor should be forgotten")
+
+	_, _, _, ok = ct.observeReply(marshalDoc(t, bson.D{{Key: "ok", Value: 1.0}}), commandInfo{})
+	require.False(t, ok)
+}
+
+func TestCursorTrackerSplit(t *testing.T) {
+	var ct cursorTracker
+
+	split, err := ct.split(cursorReplyDoc(t, "firstBatch", 42, 5, 0), 2, 1)
+	require.NoError(t, err)
+
+	ids, id := batchIDs(t, split)
+	require.Equal(t, []int32{0, 1}, ids)
+	require.Equal(t, int64(42), id)
+	require.Equal(t, 1.0, split.Lookup("ok").Double(), "other fields should be kept")
+
+	reply, ok := ct.bufferedReply(42)
+	require.True(t, ok)
+	ids, id = batchIDs(t, reply)
+	require.Equal(t, []int32{2, 3}, ids)
+	require.Equal(t, int64(42), id)
+
+	reply, ok = ct.bufferedReply(42)
+	require.True(t, ok)
+	ids, id = batchIDs(t, reply)
+	require.Equal(t, []int32{4}, ids)
+	require.Equal(t, int64(42), id, "server cursor is still open")
+
+	_, ok = ct.bufferedReply(42)
+	require.False(t, ok, "getMore should go to the server")
+}
+
+func TestCursorTrackerSplitExhausted(t *testing.T) {
+	var ct cursorTracker
+
+	split, err := ct.split(cursorReplyDoc(t, "firstBatch", 0, 3, 0), 2, 1)
+	require.NoError(t, err)
+
+	ids, id := batchIDs(t, split)
+	require.Equal(t, []int32{0, 1}, ids)
+	require.Equal(t, syntheticCursorBase, id)
+
+	reply, ok := ct.bufferedReply(id)
+	require.True(t, ok)
+	ids, replyID := batchIDs(t, reply)
+	require.Equal(t, []int32{2}, ids)
+	require.Zero(t, replyID, "synthetic cursor should be closed with its last batch")
+	require.Empty(t, ct.cursors)
+}
+
+func TestCursorTrackerSplitSmallBatch(t *testing.T) {
+	var ct cursorTracker
+
+	reply := cursorReplyDoc(t, "nextBatch", 42, 2, 0)
+	split, err := ct.split(reply, 2, 1)
+	require.NoError(t, err)
+	require.Equal(t, reply, split)
+
+	_, err = ct.split(marshalDoc(t, bson.D{{Key: "ok", Value: 1.0}}), 2, 1)
+	require.Error(t, err)
+}
+
+func TestCursorIDs(t *testing.T) {
+	cmd := marshalDoc(t, bson.D{
+		{Key: "killCursors", Value: "coll"},
+		{Key: "cursors", Value: bson.A{int64(1), int64(2)}},
+	})
+	require.Equal(t, []int64{1, 2}, cursorIDs(cmd))
+	require.Empty(t, cursorIDs(marshalDoc(t, bson.D{{Key: "ping", Value: 1}})))
+}
+
+func TestCursorTrackerChangeStream(t *testing.T) {
+	var ct cursorTracker
+
+	agg := marshalDoc(t, bson.D{
+		{Key: "aggregate", Value: 1},
+		{Key: "pipeline", Value: bson.A{bson.D{{Key: "$changeStream", Value: bson.D{}}}}},
+	})
+	require.True(t, isChangeStream(agg))
+
+	info := commandInfo{name: "aggregate", changeStream: true}
+	ct.observeReply(cursorReplyDoc(t, "firstBatch", 42, 0, 0), info)
+	ct.observeReply(cursorReplyDoc(t, "firstBatch", 7, 1, 0), commandInfo{name: "find"})
+
+	getMore := commandInfo{name: "getMore", cursorID: 42}
+	ct.startGetMore(&getMore)
+	require.True(t, getMore.changeStream)
+
+	getMore = commandInfo{name: "getMore", cursorID: 7}
+	ct.startGetMore(&getMore)
+	require.False(t, getMore.changeStream)
+}
+
+func TestIsChangeStream(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  bson.D
+		want bool
+	}{
+		{
+			name: "change stream",
+			cmd: bson.D{
+				{Key: "aggregate", Value: "coll"},
+				{Key: "pipeline", Value: bson.A{
+					bson.D{{Key: "$changeStream", Value: bson.D{}}},
+					bson.D{{Key: "$match", Value: bson.D{}}},
+				}},
+			},
+			want: true,
+		},
+		{
+			name: "later stage",
+			cmd: bson.D{
+				{Key: "aggregate", Value: "coll"},
+				{Key: "pipeline", Value: bson.A{
+					bson.D{{Key: "$match", Value: bson.D{}}},
+					bson.D{{Key: "$changeStream", Value: bson.D{}}},
+				}},
+			},
+		},
+		{
+			name: "empty pipeline",
+			cmd:  bson.D{{Key: "aggregate", Value: "coll"}, {Key: "pipeline", Value: bson.A{}}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, isChangeStream(marshalDoc(t, tc.cmd)))
+		})
+	}
+}
+
+func TestRemoveCursorField(t *testing.T) {
+	reply := marshalDoc(t, bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "nextBatch", Value: bson.A{}},
+			{Key: "postBatchResumeToken", Value: bson.D{{Key: "_data", Value: "8263"}}},
+			{Key: "id", Value: int64(42)},
+		}},
+		{Key: "ok", Value: 1.0},
+	})
+
+	stripped, err := removeCursorField(reply, "postBatchResumeToken")
+	require.NoError(t, err)
+
+	_, err = stripped.LookupErr("cursor", "postBatchResumeToken")
+	require.Error(t, err)
+	require.Equal(t, int64(42), stripped.Lookup("cursor", "id").Int64())
+	require.Equal(t, 1.0, stripped.Lookup("ok").Double())
+}
+
+func TestCursorTrackerCloseConn(t *testing.T) {
+	var ct cursorTracker
+
+	_, _, _, ok := ct.observeReply(cursorReplyDoc(t, "firstBatch", 42, 1, 0), commandInfo{connID: 1, name: "find"})
+	require.True(t, ok)
+	_, _, _, ok = ct.observeReply(cursorReplyDoc(t, "firstBatch", 43, 1, 0), commandInfo{connID: 1, name: "find"})
+	require.True(t, ok)
+	_, err := ct.split(cursorReplyDoc(t, "firstBatch", 0, 3, 0), 2, 2)
+	require.NoError(t, err)
+
+	// A getMore on another connection hands the cursor over to it.
+	getMore := commandInfo{connID: 2, name: "getMore", cursorID: 43}
+	ct.startGetMore(&getMore)
+
+	ct.closeConn(1)
+	require.Len(t, ct.cursors, 2)
+	require.Contains(t, ct.cursors, int64(43))
+
+	ct.closeConn(2)
+	require.Empty(t, ct.cursors)
+}
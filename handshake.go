@@ -0,0 +1,167 @@
+package mongoproxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// replicaSetFields are the hello reply fields that only replica set members
+// send, which a mongos never does.
+var replicaSetFields = []string{
+	"setName", "setVersion", "hosts", "passives", "arbiters",
+	"primary", "secondary", "me", "electionId",
+}
+
+// helloOverrides replaces fields of a hello or isMaster reply, so one server
+// can pretend to be another version or topology.
+type helloOverrides struct {
+	MaxWireVersion               *int32    `bson:"maxWireVersion,omitempty"`
+	MinWireVersion               *int32    `bson:"minWireVersion,omitempty"`
+	MaxBsonObjectSize            *int32    `bson:"maxBsonObjectSize,omitempty"`
+	MaxMessageSizeBytes          *int32    `bson:"maxMessageSizeBytes,omitempty"`
+	MaxWriteBatchSize            *int32    `bson:"maxWriteBatchSize,omitempty"`
+	LogicalSessionTimeoutMinutes *int32    `bson:"logicalSessionTimeoutMinutes,omitempty"`
+	Compression                  *[]string `bson:"compression,omitempty"` // empty to negotiate none
+	Msg                          *string   `bson:"msg,omitempty"`         // "isdbgrid" to look like a mongos
+}
+
+// isHello reports whether name is one of the handshake commands.
+func isHello(name string) bool {
+	switch name {
+	case "hello", "isMaster", "ismaster":
+		return true
+	}
+	return false
+}
+
+// String lists the overridden fields.
+func (h *helloOverrides) String() string {
+	return strings.Join(h.fields(), ",")
+}
+
+// fields returns the reply fields h overrides, in the order they appear in
+// the struct.
+func (h *helloOverrides) fields() []string {
+	var fields []string
+	add := func(set bool, name string) {
+		if set {
+			fields = append(fields, name)
+		}
+	}
+
+	add(h.MaxWireVersion != nil, "maxWireVersion")
+	add(h.MinWireVersion != nil, "minWireVersion")
+	add(h.MaxBsonObjectSize != nil, "maxBsonObjectSize")
+	add(h.MaxMessageSizeBytes != nil, "maxMessageSizeBytes")
+	add(h.MaxWriteBatchSize != nil, "maxWriteBatchSize")
+	add(h.LogicalSessionTimeoutMinutes != nil, "logicalSessionTimeoutMinutes")
+	add(h.Compression != nil, "compression")
+	add(h.Msg != nil, "msg")
+	return fields
+}
+
+// apply returns reply with the overridden fields replaced, or added if the
+// server did not send them.
+func (h *helloOverrides) apply(reply bson.Raw) (bson.Raw, error) {
+	var doc bson.D
+	if err := bson.Unmarshal(reply, &doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reply: %w", err)
+	}
+
+	if h.MaxWireVersion != nil {
+		doc = setField(doc, "maxWireVersion", *h.MaxWireVersion)
+	}
+	if h.MinWireVersion != nil {
+		doc = setField(doc, "minWireVersion", *h.MinWireVersion)
+	}
+	if h.MaxBsonObjectSize != nil {
+		doc = setField(doc, "maxBsonObjectSize", *h.MaxBsonObjectSize)
+	}
+	if h.MaxMessageSizeBytes != nil {
+		doc = setField(doc, "maxMessageSizeBytes", *h.MaxMessageSizeBytes)
+	}
+	if h.MaxWriteBatchSize != nil {
+		doc = setField(doc, "maxWriteBatchSize", *h.MaxWriteBatchSize)
+	}
+	if h.LogicalSessionTimeoutMinutes != nil {
+		doc = setField(doc, "logicalSessionTimeoutMinutes", *h.LogicalSessionTimeoutMinutes)
+	}
+	if h.Compression != nil {
+		if len(*h.Compression) == 0 {
+			doc = unsetFields(doc, "compression")
+		} else {
+			doc = setField(doc, "compression", *h.Compression)
+		}
+	}
+	if h.Msg != nil {
+		doc = setField(doc, "msg", *h.Msg)
+		if *h.Msg == "isdbgrid" {
+			doc = unsetFields(doc, replicaSetFields...)
+		}
+	}
+
+	return bson.Marshal(doc)
+}
+
+// removeCompressors returns the hello command cmd without the given
+// compressors in its compression list, or without any if names is empty.
+func removeCompressors(cmd bson.Raw, names []string) (bson.Raw, error) {
+	var doc bson.D
+	if err := bson.Unmarshal(cmd, &doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal command: %w", err)
+	}
+
+	for i, elem := range doc {
+		if elem.Key != "compression" {
+			continue
+		}
+
+		offered, ok := elem.Value.(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("compression is a %T, not an array", elem.Value)
+		}
+
+		kept := bson.A{}
+		for _, c := range offered {
+			name, _ := c.(string)
+			if len(names) > 0 && !slices.Contains(names, name) {
+				kept = append(kept, c)
+			}
+		}
+		doc[i].Value = kept
+	}
+
+	return bson.Marshal(doc)
+}
+
+// setField replaces the value of key in doc, or appends it.
+func setField(doc bson.D, key string, value any) bson.D {
+	for i := range doc {
+		if doc[i].Key == key {
+			doc[i].Value = value
+			return doc
+		}
+	}
+	return append(doc, bson.E{Key: key, Value: value})
+}
+
+// unsetFields removes the given keys from doc.
+func unsetFields(doc bson.D, keys ...string) bson.D {
+	kept := doc[:0]
+	for _, elem := range doc {
+		remove := false
+		for _, key := range keys {
+			if elem.Key == key {
+				remove = true
+				break
+			}
+		}
+		if !remove {
+			kept = append(kept, elem)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,183 @@
+package mongoproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/x/mongo/driver/wiremessage"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func helloReply(t *testing.T) bson.Raw {
+	t.Helper()
+
+	return marshalDoc(t, bson.D{
+		{Key: "isWritablePrimary", Value: true},
+		{Key: "setName", Value: "rs0"},
+		{Key: "hosts", Value: bson.A{"localhost:27017"}},
+		{Key: "maxBsonObjectSize", Value: int32(16777216)},
+		{Key: "maxWireVersion", Value: int32(17)},
+		{Key: "compression", Value: bson.A{"zstd"}},
+		{Key: "ok", Value: 1.0},
+	})
+}
+
+func TestHelloOverridesApply(t *testing.T) {
+	h := &helloOverrides{
+		MaxWireVersion:               ptr(int32(7)),
+		MaxWriteBatchSize:            ptr(int32(2)),
+		LogicalSessionTimeoutMinutes: ptr(int32(30)),
+	}
+
+	reply, err := h.apply(helloReply(t))
+	require.NoError(t, err)
+
+	require.Equal(t, int32(7), reply.Lookup("maxWireVersion").Int32())
+	require.Equal(t, int32(2), reply.Lookup("maxWriteBatchSize").Int32(), "missing fields should be added")
+	require.Equal(t, int32(30), reply.Lookup("logicalSessionTimeoutMinutes").Int32())
+	require.Equal(t, "rs0", reply.Lookup("setName").StringValue(), "other fields should be kept")
+	require.Equal(t, "maxWireVersion,maxWriteBatchSize,logicalSessionTimeoutMinutes", h.String())
+}
+
+func TestHelloOverridesMongos(t *testing.T) {
+	h := &helloOverrides{Msg: ptr("isdbgrid")}
+
+	reply, err := h.apply(helloReply(t))
+	require.NoError(t, err)
+
+	require.Equal(t, "isdbgrid", reply.Lookup("msg").StringValue())
+	for _, key := range []string{"setName", "hosts"} {
+		_, err := reply.LookupErr(key)
+		require.Error(t, err, "%s should be removed", key)
+	}
+	require.True(t, reply.Lookup("isWritablePrimary").Boolean())
+}
+
+func TestHelloOverridesCompression(t *testing.T) {
+	h := &helloOverrides{Compression: &[]string{"snappy"}}
+	reply, err := h.apply(helloReply(t))
+	require.NoError(t, err)
+
+	values, err := reply.Lookup("compression").Array().Values()
+	require.NoError(t, err)
+	require.Len(t, values, 1)
+	require.Equal(t, "snappy", values[0].StringValue())
+
+	h = &helloOverrides{Compression: &[]string{}}
+	reply, err = h.apply(helloReply(t))
+	require.NoError(t, err)
+
+	_, err = reply.LookupErr("compression")
+	require.Error(t, err, "an empty list should negotiate no compressor")
+}
+
+func TestRemoveCompressors(t *testing.T) {
+	hello := marshalDoc(t, bson.D{
+		{Key: "hello", Value: 1},
+		{Key: "compression", Value: bson.A{"zstd", "snappy", "zlib"}},
+	})
+
+	offered := func(doc bson.Raw) []string {
+		values, err := doc.Lookup("compression").Array().Values()
+		require.NoError(t, err)
+
+		names := []string{}
+		for _, v := range values {
+			names = append(names, v.StringValue())
+		}
+		return names
+	}
+
+	doc, err := removeCompressors(hello, []string{"zstd"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"snappy", "zlib"}, offered(doc))
+
+	doc, err = removeCompressors(hello, nil)
+	require.NoError(t, err)
+	require.Empty(t, offered(doc))
+
+	plain := marshalDoc(t, bson.D{{Key: "hello", Value: 1}})
+	doc, err = removeCompressors(plain, nil)
+	require.NoError(t, err)
+	require.Equal(t, plain, doc)
+}
+
+// streamedReply builds a heartbeat of an exhaust stream: an OP_MSG with
+// moreToCome set.
+func streamedReply(t *testing.T, requestID, responseTo int32) []byte {
+	t.Helper()
+
+	raw := buildMsg(requestID, responseTo, helloReply(t))
+	binary.LittleEndian.PutUint32(raw[16:], uint32(wiremessage.MoreToCome))
+	return raw
+}
+
+func TestExhaustStreamKeepsOverrides(t *testing.T) {
+	server, serverPeer := net.Pipe()
+	client, clientPeer := net.Pipe()
+	defer serverPeer.Close()
+	defer clientPeer.Close()
+
+	pc := newProxyConn(&Proxy{ctx: context.Background(), stats: newMetrics()}, client, server)
+	go proxyMongoToClient(pc)
+
+	pc.startCommand(1, inflightCommand{requestID: 1, name: "hello", span: noop.Span{}})
+	pc.setPending(&testInstruction{Actions: []action{
+		{OverrideHello: &helloOverrides{MaxWireVersion: ptr(int32(8))}},
+		{DelayMs: ptr(0)},
+	}})
+
+	// Each heartbeat answers the one before it.
+	for i, responseTo := range []int32{1, 10, 11} {
+		go serverPeer.Write(streamedReply(t, int32(10+i), responseTo))
+
+		raw, err := readWireMessage(clientPeer)
+		require.NoError(t, err)
+
+		reply, ok := msgDocument(raw)
+		require.True(t, ok)
+		require.Equal(t, int32(8), reply.Lookup("maxWireVersion").Int32(), "heartbeat %d", i)
+	}
+
+	_, ok := pc.finishCommand(12)
+	require.True(t, ok, "the stream goes on")
+}
+
+func TestExhaustStreamMatchesRules(t *testing.T) {
+	server, serverPeer := net.Pipe()
+	client, clientPeer := net.Pipe()
+	defer serverPeer.Close()
+	defer clientPeer.Close()
+
+	p := &Proxy{ctx: context.Background(), stats: newMetrics()}
+	p.rules.arm(rule{
+		Match:   ruleMatch{Connection: ptr("monitoring")},
+		Actions: []action{{OverrideHello: &helloOverrides{Msg: ptr("isdbgrid")}}},
+		Times:   ptr(-1),
+	}, commandInfo{})
+
+	pc := newProxyConn(p, client, server)
+	go proxyMongoToClient(pc)
+
+	// The streaming hello itself went through the rules when it was sent.
+	info := commandInfo{requestID: 1, name: "hello", connKind: kindMonitoring}
+	pc.startCommand(1, inflightCommand{requestID: 1, info: info, name: "hello", span: noop.Span{}})
+	pc.setPending(p.replyInstruction(info, nil))
+
+	for i, responseTo := range []int32{1, 10, 11} {
+		go serverPeer.Write(streamedReply(t, int32(10+i), responseTo))
+
+		raw, err := readWireMessage(clientPeer)
+		require.NoError(t, err)
+
+		reply, ok := msgDocument(raw)
+		require.True(t, ok)
+		require.Equal(t, "isdbgrid", reply.Lookup("msg").StringValue(), "heartbeat %d", i)
+	}
+
+	require.Equal(t, int64(3), p.faults.snapshot()["overrideHello"], "each heartbeat is matched, and overridden once")
+}
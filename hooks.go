@@ -0,0 +1,67 @@
+package mongoproxy
+
+import (
+	"net"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Hooks are callbacks fired as traffic passes through the proxy. Any of them
+// may be nil. They run on the connection's own goroutines, so they must be
+// safe for concurrent use, and the connection waits for them to return.
+type Hooks struct {
+	// OnConnect is called once the proxy has dialed the target for a new
+	// client connection.
+	OnConnect func(ConnEvent)
+
+	// OnDisconnect is called when a proxied connection closes.
+	OnDisconnect func(ConnEvent)
+
+	// OnCommand is called for every command read from the client, OP_MSG or
+	// OP_QUERY, after proxyTest has been removed. Returning a non-nil document
+	// forwards it in place of the original.
+	OnCommand func(CommandEvent) bson.Raw
+
+	// OnReply is called for every reply read from the server, OP_MSG or
+	// OP_REPLY, and for every reply the proxy answers itself. Returning a
+	// non-nil document sends it to the client in place of the original.
+	OnReply func(ReplyEvent) bson.Raw
+
+	// OnFault is called as each proxyTest action is applied to a reply.
+	OnFault func(FaultEvent)
+}
+
+// ConnEvent describes a proxied connection.
+type ConnEvent struct {
+	ConnID     int64    // Unique per proxy, in accept order
+	ClientAddr net.Addr // Remote address of the client
+	ServerAddr net.Addr // Address of the target server
+}
+
+// CommandEvent describes a command read from the client.
+type CommandEvent struct {
+	ConnID    int64
+	RequestID int32
+	Name      string   // Command name, e.g. "find"
+	Database  string   // Value of $db, or the database an OP_QUERY is sent to
+	Command   bson.Raw // Command document without proxyTest
+}
+
+// ReplyEvent describes a reply read from the server.
+type ReplyEvent struct {
+	ConnID     int64
+	ResponseTo int32
+	Name       string        // Name of the command answered, if known
+	Duration   time.Duration // Time the server took to reply, if known
+	Reply      bson.Raw      // Reply document
+}
+
+// FaultEvent describes a proxyTest action applied to a reply.
+type FaultEvent struct {
+	ConnID     int64
+	ResponseTo int32
+	Name       string // Name of the command answered, if known
+	Action     string // Action type, e.g. "delayMs"
+	Detail     string // Action and its parameters, e.g. "delayMs=200"
+}
@@ -0,0 +1,105 @@
+package mongoproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/v2/x/mongo/driver/wiremessage"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// buildOpMsg builds an OP_MSG with a body section followed by a document
+// sequence of seq.
+func buildOpMsg(t *testing.T, requestID, responseTo int32, body bson.D, seq ...bson.D) []byte {
+	t.Helper()
+
+	doc, err := bson.Marshal(body)
+	require.NoError(t, err)
+
+	idx, raw := wiremessage.AppendHeaderStart(nil, requestID, responseTo, wiremessage.OpMsg)
+	raw = wiremessage.AppendMsgFlags(raw, 0)
+	raw = wiremessage.AppendMsgSectionType(raw, wiremessage.SingleDocument)
+	raw = append(raw, doc...)
+
+	if len(seq) > 0 {
+		raw = wiremessage.AppendMsgSectionType(raw, wiremessage.DocumentSequence)
+		seqIdx, seqBuf := bsoncore.ReserveLength(raw)
+		seqBuf = append(seqBuf, "documents\x00"...)
+		for _, d := range seq {
+			b, err := bson.Marshal(d)
+			require.NoError(t, err)
+			seqBuf = append(seqBuf, b...)
+		}
+		raw = bsoncore.UpdateLength(seqBuf, seqIdx, int32(len(seqBuf[seqIdx:])))
+	}
+
+	return bsoncore.UpdateLength(raw, idx, int32(len(raw[idx:])))
+}
+
+func TestHooksLegacyHandshake(t *testing.T) {
+	server, peer := net.Pipe()
+	defer peer.Close()
+
+	var got CommandEvent
+	p := &Proxy{ctx: context.Background(), stats: newMetrics(), tracer: noopTracer, hooks: Hooks{
+		OnCommand: func(ev CommandEvent) bson.Raw {
+			got = ev
+			return marshalDoc(t, bson.D{{Key: "isMaster", Value: 1}, {Key: "hooked", Value: true}})
+		},
+		OnReply: func(ev ReplyEvent) bson.Raw {
+			return marshalDoc(t, bson.D{{Key: "ismaster", Value: false}, {Key: "ok", Value: 1.0}})
+		},
+	}}
+	pc := newProxyConn(p, addrConn{addr: "10.0.0.1:5000"}, server)
+
+	go pc.forwardQuery(buildOpQuery(t, 4, "admin.$cmd", bson.D{{Key: "isMaster", Value: 1}}), 4)
+
+	forwarded, err := readWireMessage(peer)
+	require.NoError(t, err)
+	require.Equal(t, "isMaster", got.Name)
+	require.Equal(t, "admin", got.Database)
+
+	doc, ok := queryCommand(forwarded)
+	require.True(t, ok)
+	require.True(t, doc.Lookup("hooked").Boolean(), "OnCommand replaces OP_QUERY commands")
+
+	raw := buildOpReply(t, 4, bson.D{{Key: "ismaster", Value: true}, {Key: "ok", Value: 1.0}})
+	reply, ok := replyDocument(raw)
+	require.True(t, ok)
+
+	raw, reply = pc.onReply(4, inflightCommand{name: "isMaster"}, raw, reply)
+	require.False(t, reply.Lookup("ismaster").Boolean())
+
+	doc, ok = replyDocument(raw)
+	require.True(t, ok)
+	require.Equal(t, reply, doc, "OnReply replaces OP_REPLY replies")
+}
+
+func TestAnswerFiresOnReply(t *testing.T) {
+	client, peer := net.Pipe()
+	defer peer.Close()
+
+	var got ReplyEvent
+	p := &Proxy{ctx: context.Background(), stats: newMetrics(), hooks: Hooks{
+		OnReply: func(ev ReplyEvent) bson.Raw {
+			got = ev
+			return marshalDoc(t, bson.D{{Key: "ok", Value: 1.0}, {Key: "hooked", Value: true}})
+		},
+	}}
+	pc := newProxyConn(p, client, nil)
+
+	go pc.answer(inflightCommand{requestID: 6, name: "ping", span: noop.Span{}}, marshalDoc(t, bson.D{{Key: "ok", Value: 1.0}}), nil)
+
+	raw, err := readWireMessage(peer)
+	require.NoError(t, err)
+	require.Equal(t, int32(6), got.ResponseTo)
+	require.Equal(t, "ping", got.Name)
+
+	doc, ok := msgDocument(raw)
+	require.True(t, ok)
+	require.True(t, doc.Lookup("hooked").Boolean(), "OnReply replaces replies the proxy answers itself")
+}
@@ -0,0 +1,196 @@
+package mongoproxy
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/v2/x/mongo/driver/wiremessage"
+)
+
+// Drivers still send the first hello of a connection as an OP_QUERY on
+// "admin.$cmd" unless they use the stable API or a load balancer, and the
+// server answers it with an OP_REPLY. These helpers let the handshake be
+// matched and rewritten like any OP_MSG command.
+
+// queryCommand returns the command in an OP_QUERY wire message, if it is one.
+func queryCommand(raw []byte) (bson.Raw, bool) {
+	_, _, _, opcode, body, ok := wiremessage.ReadHeader(raw)
+	if !ok || opcode != wiremessage.OpQuery {
+		return nil, false
+	}
+
+	_, body, ok = wiremessage.ReadQueryFlags(body)
+	if !ok {
+		return nil, false
+	}
+
+	coll, body, ok := wiremessage.ReadQueryFullCollectionName(body)
+	if !ok || !strings.HasSuffix(coll, ".$cmd") {
+		return nil, false
+	}
+
+	_, body, ok = wiremessage.ReadQueryNumberToSkip(body)
+	if !ok {
+		return nil, false
+	}
+	_, body, ok = wiremessage.ReadQueryNumberToReturn(body)
+	if !ok {
+		return nil, false
+	}
+
+	query, _, ok := wiremessage.ReadQueryQuery(body)
+	if !ok {
+		return nil, false
+	}
+
+	// Commands with read preferences are wrapped as {$query: {...}}.
+	if inner, ok := bson.Raw(query).Lookup("$query").DocumentOK(); ok {
+		return inner, true
+	}
+	return bson.Raw(query), true
+}
+
+// queryDatabase returns the database an OP_QUERY wire message is sent to,
+// e.g. "admin" for "admin.$cmd".
+func queryDatabase(raw []byte) string {
+	_, _, _, opcode, body, ok := wiremessage.ReadHeader(raw)
+	if !ok || opcode != wiremessage.OpQuery {
+		return ""
+	}
+
+	_, body, ok = wiremessage.ReadQueryFlags(body)
+	if !ok {
+		return ""
+	}
+	coll, _, ok := wiremessage.ReadQueryFullCollectionName(body)
+	if !ok {
+		return ""
+	}
+
+	db, _, _ := strings.Cut(coll, ".")
+	return db
+}
+
+// replaceQueryCommand rebuilds an OP_QUERY wire message with doc as its
+// command, keeping any $query wrapper around it.
+func replaceQueryCommand(raw []byte, doc bson.Raw) ([]byte, bool) {
+	_, requestID, responseTo, opcode, body, ok := wiremessage.ReadHeader(raw)
+	if !ok || opcode != wiremessage.OpQuery {
+		return nil, false
+	}
+
+	flags, body, ok := wiremessage.ReadQueryFlags(body)
+	if !ok {
+		return nil, false
+	}
+	coll, body, ok := wiremessage.ReadQueryFullCollectionName(body)
+	if !ok {
+		return nil, false
+	}
+	skip, body, ok := wiremessage.ReadQueryNumberToSkip(body)
+	if !ok {
+		return nil, false
+	}
+	limit, body, ok := wiremessage.ReadQueryNumberToReturn(body)
+	if !ok {
+		return nil, false
+	}
+	query, rest, ok := wiremessage.ReadQueryQuery(body)
+	if !ok {
+		return nil, false
+	}
+
+	if _, wrapped := bson.Raw(query).Lookup("$query").DocumentOK(); wrapped {
+		var outer bson.D
+		if err := bson.Unmarshal(query, &outer); err != nil {
+			return nil, false
+		}
+		for i := range outer {
+			if outer[i].Key == "$query" {
+				outer[i].Value = doc
+			}
+		}
+
+		var err error
+		if doc, err = bson.Marshal(outer); err != nil {
+			return nil, false
+		}
+	}
+
+	idx, buf := wiremessage.AppendHeaderStart(nil, requestID, responseTo, wiremessage.OpQuery)
+	buf = wiremessage.AppendQueryFlags(buf, flags)
+	buf = wiremessage.AppendQueryFullCollectionName(buf, coll)
+	buf = wiremessage.AppendQueryNumberToSkip(buf, skip)
+	buf = wiremessage.AppendQueryNumberToReturn(buf, limit)
+	buf = append(buf, doc...)
+	buf = append(buf, rest...) // returnFieldsSelector, if any
+	return bsoncore.UpdateLength(buf, idx, int32(len(buf[idx:]))), true
+}
+
+// replyDocument returns the reply document of an OP_MSG or OP_REPLY wire
+// message.
+func replyDocument(raw []byte) (bson.Raw, bool) {
+	if doc, ok := msgDocument(raw); ok {
+		return doc, true
+	}
+
+	_, _, _, opcode, body, ok := wiremessage.ReadHeader(raw)
+	if !ok || opcode != wiremessage.OpReply {
+		return nil, false
+	}
+
+	_, body, ok = wiremessage.ReadReplyFlags(body)
+	if !ok {
+		return nil, false
+	}
+	_, body, ok = wiremessage.ReadReplyCursorID(body)
+	if !ok {
+		return nil, false
+	}
+	_, body, ok = wiremessage.ReadReplyStartingFrom(body)
+	if !ok {
+		return nil, false
+	}
+	n, body, ok := wiremessage.ReadReplyNumberReturned(body)
+	if !ok || n != 1 {
+		return nil, false
+	}
+
+	doc, _, ok := wiremessage.ReadReplyDocument(body)
+	return bson.Raw(doc), ok
+}
+
+// replaceReplyDocument is replaceMsgDocument for OP_MSG and OP_REPLY wire
+// messages.
+func replaceReplyDocument(raw []byte, doc bson.Raw) ([]byte, bool) {
+	if rebuilt, ok := replaceMsgDocument(raw, doc); ok {
+		return rebuilt, true
+	}
+
+	_, requestID, responseTo, opcode, body, ok := wiremessage.ReadHeader(raw)
+	if !ok || opcode != wiremessage.OpReply {
+		return nil, false
+	}
+
+	flags, body, ok := wiremessage.ReadReplyFlags(body)
+	if !ok {
+		return nil, false
+	}
+	cursorID, body, ok := wiremessage.ReadReplyCursorID(body)
+	if !ok {
+		return nil, false
+	}
+	startingFrom, _, ok := wiremessage.ReadReplyStartingFrom(body)
+	if !ok {
+		return nil, false
+	}
+
+	idx, buf := wiremessage.AppendHeaderStart(nil, requestID, responseTo, wiremessage.OpReply)
+	buf = wiremessage.AppendReplyFlags(buf, flags)
+	buf = wiremessage.AppendReplyCursorID(buf, cursorID)
+	buf = wiremessage.AppendReplyStartingFrom(buf, startingFrom)
+	buf = wiremessage.AppendReplyNumberReturned(buf, 1)
+	buf = append(buf, doc...)
+	return bsoncore.UpdateLength(buf, idx, int32(len(buf[idx:]))), true
+}
@@ -0,0 +1,117 @@
+package mongoproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/v2/x/mongo/driver/wiremessage"
+)
+
+func buildOpQuery(t *testing.T, requestID int32, coll string, query bson.D) []byte {
+	t.Helper()
+
+	idx, buf := wiremessage.AppendHeaderStart(nil, requestID, 0, wiremessage.OpQuery)
+	buf = wiremessage.AppendQueryFlags(buf, 0)
+	buf = wiremessage.AppendQueryFullCollectionName(buf, coll)
+	buf = wiremessage.AppendQueryNumberToSkip(buf, 0)
+	buf = wiremessage.AppendQueryNumberToReturn(buf, -1)
+	buf = append(buf, marshalDoc(t, query)...)
+	return bsoncore.UpdateLength(buf, idx, int32(len(buf[idx:])))
+}
+
+func buildOpReply(t *testing.T, responseTo int32, doc bson.D) []byte {
+	t.Helper()
+
+	idx, buf := wiremessage.AppendHeaderStart(nil, 1, responseTo, wiremessage.OpReply)
+	buf = wiremessage.AppendReplyFlags(buf, wiremessage.AwaitCapable)
+	buf = wiremessage.AppendReplyCursorID(buf, 0)
+	buf = wiremessage.AppendReplyStartingFrom(buf, 0)
+	buf = wiremessage.AppendReplyNumberReturned(buf, 1)
+	buf = append(buf, marshalDoc(t, doc)...)
+	return bsoncore.UpdateLength(buf, idx, int32(len(buf[idx:])))
+}
+
+func TestQueryCommand(t *testing.T) {
+	raw := buildOpQuery(t, 1, "admin.$cmd", bson.D{{Key: "isMaster", Value: 1}, {Key: "helloOk", Value: true}})
+	doc, ok := queryCommand(raw)
+	require.True(t, ok)
+	require.Equal(t, "isMaster", commandName(doc))
+	require.Equal(t, "admin", queryDatabase(raw))
+
+	wrapped := buildOpQuery(t, 1, "admin.$cmd", bson.D{
+		{Key: "$query", Value: bson.D{{Key: "isMaster", Value: 1}}},
+		{Key: "$readPreference", Value: bson.D{{Key: "mode", Value: "primaryPreferred"}}},
+	})
+	doc, ok = queryCommand(wrapped)
+	require.True(t, ok)
+	require.Equal(t, "isMaster", commandName(doc))
+
+	_, ok = queryCommand(buildOpQuery(t, 1, "test.coll", bson.D{{Key: "x", Value: 1}}))
+	require.False(t, ok, "a query on a collection is not a command")
+}
+
+func TestReplaceReplyDocument(t *testing.T) {
+	raw := buildOpReply(t, 7, bson.D{{Key: "ismaster", Value: true}, {Key: "ok", Value: 1.0}})
+
+	doc, ok := replyDocument(raw)
+	require.True(t, ok)
+	require.True(t, doc.Lookup("ismaster").Boolean())
+
+	replacement := marshalDoc(t, bson.D{{Key: "ok", Value: 0.0}, {Key: "code", Value: int32(91)}})
+	rebuilt, ok := replaceReplyDocument(raw, replacement)
+	require.True(t, ok)
+
+	_, _, responseTo, opcode, _, ok := wiremessage.ReadHeader(rebuilt)
+	require.True(t, ok)
+	require.Equal(t, int32(7), responseTo)
+	require.Equal(t, wiremessage.OpReply, opcode)
+
+	doc, ok = replyDocument(rebuilt)
+	require.True(t, ok)
+	require.Equal(t, replacement, doc)
+
+	// OP_MSG replies go through replaceMsgDocument.
+	msg := buildOpMsg(t, 1, 7, bson.D{{Key: "ok", Value: 1.0}})
+	rebuilt, ok = replaceReplyDocument(msg, replacement)
+	require.True(t, ok)
+	doc, ok = replyDocument(rebuilt)
+	require.True(t, ok)
+	require.Equal(t, replacement, doc)
+}
+
+func TestReplaceQueryCommand(t *testing.T) {
+	replacement := marshalDoc(t, bson.D{{Key: "isMaster", Value: 1}, {Key: "compression", Value: bson.A{}}})
+
+	raw := buildOpQuery(t, 3, "admin.$cmd", bson.D{{Key: "isMaster", Value: 1}})
+	rebuilt, ok := replaceQueryCommand(raw, replacement)
+	require.True(t, ok)
+
+	doc, ok := queryCommand(rebuilt)
+	require.True(t, ok)
+	require.Equal(t, replacement, doc)
+
+	_, requestID, _, _, _, ok := wiremessage.ReadHeader(rebuilt)
+	require.True(t, ok)
+	require.Equal(t, int32(3), requestID)
+
+	wrapped := buildOpQuery(t, 3, "admin.$cmd", bson.D{
+		{Key: "$query", Value: bson.D{{Key: "isMaster", Value: 1}}},
+		{Key: "$readPreference", Value: bson.D{{Key: "mode", Value: "primaryPreferred"}}},
+	})
+	rebuilt, ok = replaceQueryCommand(wrapped, replacement)
+	require.True(t, ok)
+
+	doc, ok = queryCommand(rebuilt)
+	require.True(t, ok)
+	require.Equal(t, replacement, doc)
+
+	_, _, _, _, body, _ := wiremessage.ReadHeader(rebuilt)
+	_, body, _ = wiremessage.ReadQueryFlags(body)
+	_, body, _ = wiremessage.ReadQueryFullCollectionName(body)
+	_, body, _ = wiremessage.ReadQueryNumberToSkip(body)
+	_, body, _ = wiremessage.ReadQueryNumberToReturn(body)
+	query, _, _ := wiremessage.ReadQueryQuery(body)
+	require.Equal(t, "primaryPreferred", bson.Raw(query).Lookup("$readPreference", "mode").StringValue())
+}
@@ -0,0 +1,136 @@
+package mongoproxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "mongoproxy"
+
+// Directions used to label per-direction metrics.
+const (
+	directionClientToServer = "client_to_server"
+	directionServerToClient = "server_to_client"
+)
+
+// metrics are the Prometheus metrics of one proxy. They are registered on the
+// proxy's own registry, so proxies in the same process, such as those of a
+// scenario, do not share counters.
+type metrics struct {
+	registry *prometheus.Registry
+
+	connectionsActive         prometheus.Gauge
+	connectionsTotal          prometheus.Counter
+	bytesTotal                *prometheus.CounterVec
+	messagesTotal             *prometheus.CounterVec
+	faultsTotal               *prometheus.CounterVec
+	clientConnectionsActive   *prometheus.GaugeVec
+	connectionsRefusedTotal   prometheus.Counter
+	upstreamDialFailuresTotal prometheus.Counter
+	commandDuration           *prometheus.HistogramVec
+}
+
+// newMetrics returns metrics registered on a new registry, along with the Go
+// runtime and process collectors.
+func newMetrics() *metrics {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	factory := promauto.With(registry)
+
+	return &metrics{
+		registry: registry,
+
+		connectionsActive: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "connections_active",
+			Help:      "Number of client connections currently being proxied.",
+		}),
+
+		connectionsTotal: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "connections_total",
+			Help:      "Total number of client connections accepted.",
+		}),
+
+		bytesTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "bytes_total",
+			Help:      "Total number of wire message bytes read, by direction.",
+		}, []string{"direction"}),
+
+		messagesTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_total",
+			Help:      "Total number of wire messages read, by direction, opcode and command name.",
+		}, []string{"direction", "opcode", "command"}),
+
+		faultsTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "faults_total",
+			Help:      "Total number of proxyTest actions applied, by action type.",
+		}, []string{"action"}),
+
+		clientConnectionsActive: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "client_connections_active",
+			Help:      "Number of client connections currently being proxied that have sent their handshake, by application and driver name.",
+		}, []string{"app", "driver"}),
+
+		connectionsRefusedTotal: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "connections_refused_total",
+			Help:      "Total number of client connections refused while the network was partitioned.",
+		}),
+
+		upstreamDialFailuresTotal: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_dial_failures_total",
+			Help:      "Total number of failed attempts to dial the target server.",
+		}),
+
+		commandDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "command_duration_seconds",
+			Help:      "Time between forwarding a command to the target server and reading its reply.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}, []string{"command"}),
+	}
+}
+
+// observeMessage records the size of a wire message read in the given
+// direction.
+func (m *metrics) observeMessage(direction string, raw []byte, opcode, command string) {
+	m.bytesTotal.WithLabelValues(direction).Add(float64(len(raw)))
+	m.messagesTotal.WithLabelValues(direction, opcode, command).Inc()
+}
+
+// newMetricsServer returns an HTTP server exposing m at /metrics.
+func newMetricsServer(m *metrics) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+
+	return &http.Server{Handler: mux}
+}
+
+// serveMetrics runs srv on ln until it fails or is shut down.
+func serveMetrics(srv *http.Server, ln net.Listener) error {
+	log.Printf("Metrics server listening on %s", ln.Addr())
+
+	err := srv.Serve(ln)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve metrics on %s: %w", ln.Addr(), err)
+	}
+
+	return nil
+}
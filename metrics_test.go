@@ -0,0 +1,30 @@
+package mongoproxy
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveMessage(t *testing.T) {
+	m := newMetrics()
+	msgs := m.messagesTotal.WithLabelValues(directionClientToServer, "OP_MSG", "ping")
+	bytes := m.bytesTotal.WithLabelValues(directionClientToServer)
+
+	msgsBefore := testutil.ToFloat64(msgs)
+	bytesBefore := testutil.ToFloat64(bytes)
+
+	m.observeMessage(directionClientToServer, make([]byte, 42), "OP_MSG", "ping")
+
+	require.Equal(t, msgsBefore+1, testutil.ToFloat64(msgs))
+	require.Equal(t, bytesBefore+42, testutil.ToFloat64(bytes))
+}
+
+func TestMetricsPerProxy(t *testing.T) {
+	a, b := newMetrics(), newMetrics()
+	a.connectionsTotal.Inc()
+
+	require.Equal(t, 1.0, testutil.ToFloat64(a.connectionsTotal))
+	require.Equal(t, 0.0, testutil.ToFloat64(b.connectionsTotal), "proxies must not share counters")
+}
@@ -0,0 +1,240 @@
+package mongoproxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// mutation is one edit of a mutateReply action. Paths are dotted, with array
+// elements addressed by index, e.g. "cursor.firstBatch.0._id".
+type mutation struct {
+	Op     string `bson:"op"`               // set, unset, rename, inc or truncate
+	Path   string `bson:"path"`             // field to edit
+	Value  any    `bson:"value,omitempty"`  // set: new value
+	To     string `bson:"to,omitempty"`     // rename: new path
+	By     any    `bson:"by,omitempty"`     // inc: amount, default 1
+	Length int    `bson:"length,omitempty"` // truncate: elements to keep
+}
+
+// String describes the mutation, e.g. "set n".
+func (m mutation) String() string {
+	return m.Op + " " + m.Path
+}
+
+// validate checks the mutation's op and the fields it needs.
+func (m mutation) validate() error {
+	switch m.Op {
+	case "set", "unset", "inc":
+	case "rename":
+		if m.To == "" {
+			return fmt.Errorf("rename needs to")
+		}
+	case "truncate":
+		if m.Length < 0 {
+			return fmt.Errorf("length must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown op %q, expected set, unset, rename, inc or truncate", m.Op)
+	}
+
+	if m.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	return nil
+}
+
+// editFunc returns the new value of a field given its current one, and
+// whether to keep the field at all.
+type editFunc func(old any, exists bool) (value any, keep bool, err error)
+
+// mutateReply applies ms to reply in order.
+func mutateReply(reply bson.Raw, ms []mutation) (bson.Raw, error) {
+	var doc bson.D
+	if err := bson.Unmarshal(reply, &doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reply: %w", err)
+	}
+
+	var v any = doc
+	for _, m := range ms {
+		var err error
+		if v, err = m.apply(v); err != nil {
+			return nil, fmt.Errorf("%s: %w", m, err)
+		}
+	}
+
+	return bson.Marshal(v)
+}
+
+// apply applies m to the document v.
+func (m mutation) apply(v any) (any, error) {
+	if m.Path == "" {
+		return v, fmt.Errorf("path is required")
+	}
+	path := strings.Split(m.Path, ".")
+
+	switch m.Op {
+	case "set":
+		return editPath(v, path, func(any, bool) (any, bool, error) {
+			return m.Value, true, nil
+		})
+
+	case "unset":
+		return editPath(v, path, func(any, bool) (any, bool, error) {
+			return nil, false, nil
+		})
+
+	case "rename":
+		if m.To == "" {
+			return v, fmt.Errorf("to is required")
+		}
+
+		var (
+			moved any
+			found bool
+		)
+		v, err := editPath(v, path, func(old any, exists bool) (any, bool, error) {
+			moved, found = old, exists
+			return nil, false, nil
+		})
+		if err != nil || !found {
+			return v, err
+		}
+		return editPath(v, strings.Split(m.To, "."), func(any, bool) (any, bool, error) {
+			return moved, true, nil
+		})
+
+	case "inc":
+		by := m.By
+		if by == nil {
+			by = int32(1)
+		}
+		return editPath(v, path, func(old any, exists bool) (any, bool, error) {
+			if !exists {
+				return by, true, nil
+			}
+			sum, err := increment(old, by)
+			return sum, true, err
+		})
+
+	case "truncate":
+		return editPath(v, path, func(old any, exists bool) (any, bool, error) {
+			arr, ok := old.(bson.A)
+			if !ok {
+				return old, exists, fmt.Errorf("field is a %T, not an array", old)
+			}
+			if m.Length < len(arr) {
+				arr = arr[:max(m.Length, 0)]
+			}
+			return arr, true, nil
+		})
+
+	default:
+		return v, fmt.Errorf("unknown op %q", m.Op)
+	}
+}
+
+// editPath applies fn to the field at path within v, a document or array,
+// and returns the updated v. Missing fields are added if fn keeps them, but
+// every field on the way to them must exist.
+func editPath(v any, path []string, fn editFunc) (any, error) {
+	key := path[0]
+
+	switch c := v.(type) {
+	case bson.D:
+		for i := range c {
+			if c[i].Key != key {
+				continue
+			}
+
+			if len(path) > 1 {
+				nested, err := editPath(c[i].Value, path[1:], fn)
+				c[i].Value = nested
+				return c, err
+			}
+
+			value, keep, err := fn(c[i].Value, true)
+			if err != nil {
+				return c, err
+			}
+			if !keep {
+				return append(c[:i:i], c[i+1:]...), nil
+			}
+			c[i].Value = value
+			return c, nil
+		}
+
+		if len(path) > 1 {
+			return c, fmt.Errorf("no field %q", key)
+		}
+
+		value, keep, err := fn(nil, false)
+		if err != nil || !keep {
+			return c, err
+		}
+		return append(c, bson.E{Key: key, Value: value}), nil
+
+	case bson.A:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(c) {
+			return c, fmt.Errorf("no element %q in array of %d", key, len(c))
+		}
+
+		if len(path) > 1 {
+			nested, err := editPath(c[i], path[1:], fn)
+			c[i] = nested
+			return c, err
+		}
+
+		value, keep, err := fn(c[i], true)
+		if err != nil {
+			return c, err
+		}
+		if !keep {
+			return append(c[:i:i], c[i+1:]...), nil
+		}
+		c[i] = value
+		return c, nil
+
+	default:
+		return v, fmt.Errorf("cannot find %q in a %T", key, v)
+	}
+}
+
+// increment adds by to old, keeping old's type when both are integers.
+func increment(old, by any) (any, error) {
+	switch o := old.(type) {
+	case int32:
+		switch b := by.(type) {
+		case int32:
+			return o + b, nil
+		case int64:
+			return int64(o) + b, nil
+		case float64:
+			return float64(o) + b, nil
+		}
+	case int64:
+		switch b := by.(type) {
+		case int32:
+			return o + int64(b), nil
+		case int64:
+			return o + b, nil
+		case float64:
+			return float64(o) + b, nil
+		}
+	case float64:
+		switch b := by.(type) {
+		case int32:
+			return o + float64(b), nil
+		case int64:
+			return o + float64(b), nil
+		case float64:
+			return o + b, nil
+		}
+	default:
+		return old, fmt.Errorf("field is a %T, not a number", old)
+	}
+	return old, fmt.Errorf("by is a %T, not a number", by)
+}
@@ -0,0 +1,90 @@
+package mongoproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestMutateReply(t *testing.T) {
+	reply := marshalDoc(t, bson.D{
+		{Key: "cursor", Value: bson.D{
+			{Key: "firstBatch", Value: bson.A{
+				bson.D{{Key: "_id", Value: int32(1)}},
+				bson.D{{Key: "_id", Value: int32(2)}},
+				bson.D{{Key: "_id", Value: int32(3)}},
+			}},
+			{Key: "id", Value: int64(0)},
+		}},
+		{Key: "n", Value: int32(3)},
+		{Key: "operationTime", Value: bson.Timestamp{T: 1, I: 1}},
+		{Key: "$clusterTime", Value: bson.D{{Key: "clusterTime", Value: bson.Timestamp{T: 1, I: 1}}}},
+		{Key: "ok", Value: 1.0},
+	})
+
+	mutated, err := mutateReply(reply, []mutation{
+		{Op: "truncate", Path: "cursor.firstBatch", Length: 1},
+		{Op: "set", Path: "cursor.firstBatch.0._id", Value: "wrong type"},
+		{Op: "inc", Path: "n", By: int32(-1)},
+		{Op: "unset", Path: "operationTime"},
+		{Op: "rename", Path: "$clusterTime.clusterTime", To: "$clusterTime.time"},
+		{Op: "set", Path: "extra", Value: bson.D{{Key: "a", Value: int32(1)}}},
+	})
+	require.NoError(t, err)
+
+	batch, err := mutated.Lookup("cursor", "firstBatch").Array().Values()
+	require.NoError(t, err)
+	require.Len(t, batch, 1)
+	require.Equal(t, "wrong type", batch[0].Document().Lookup("_id").StringValue())
+
+	require.Equal(t, int32(2), mutated.Lookup("n").Int32())
+
+	_, err = mutated.LookupErr("operationTime")
+	require.Error(t, err)
+
+	_, err = mutated.LookupErr("$clusterTime", "clusterTime")
+	require.Error(t, err)
+	_, err = mutated.LookupErr("$clusterTime", "time")
+	require.NoError(t, err)
+
+	require.Equal(t, int32(1), mutated.Lookup("extra", "a").Int32())
+}
+
+func TestMutateReplyErrors(t *testing.T) {
+	reply := marshalDoc(t, bson.D{{Key: "n", Value: "three"}, {Key: "ok", Value: 1.0}})
+
+	tests := []struct {
+		name string
+		m    mutation
+	}{
+		{"unknown op", mutation{Op: "push", Path: "n"}},
+		{"missing parent", mutation{Op: "set", Path: "cursor.id", Value: int64(1)}},
+		{"inc non-number", mutation{Op: "inc", Path: "n"}},
+		{"truncate non-array", mutation{Op: "truncate", Path: "n"}},
+		{"no path", mutation{Op: "unset"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := mutateReply(reply, []mutation{tc.m})
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestMutationParse(t *testing.T) {
+	cmd := marshalDoc(t, bson.D{
+		{Key: "find", Value: "coll"},
+		{Key: "proxyTest", Value: bson.D{{Key: "actions", Value: bson.A{
+			bson.D{{Key: "mutateReply", Value: bson.A{
+				bson.D{{Key: "op", Value: "set"}, {Key: "path", Value: "cursor.id"}, {Key: "value", Value: int64(7)}},
+			}}},
+		}}}},
+	})
+
+	_, instr, err := parseProxy(cmd)
+	require.NoError(t, err)
+	require.Len(t, instr.Actions, 1)
+	require.Equal(t, []mutation{{Op: "set", Path: "cursor.id", Value: int64(7)}}, instr.Actions[0].MutateReply)
+}
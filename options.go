@@ -21,6 +21,19 @@ type Config struct {
 	TargetURI  string // URI of the target MongoDB server
 	CAFile     string // Optional CA file for TLS connections
 	KeyFile    string // Optional key file for TLS connections
+
+	MetricsAddr  string // Optional address to serve Prometheus metrics on
+	AdminAddr    string // Optional address to serve the admin HTTP API on
+	OTLPEndpoint string // Optional OTLP/HTTP collector to export spans to
+
+	Tail     *TailOptions // Optional live traffic inspector; nil disables it
+	PcapFile string       // Optional pcapng file to capture wire messages to
+
+	Hooks Hooks // Optional callbacks fired as traffic passes through
+
+	TestKeys            []string // Command fields to read test instructions from; defaults to proxyTest
+	KeepTestKeys        bool     // Forward those fields to the server instead of removing them
+	CommentInstructions bool     // Also read test instructions from the command's comment
 }
 
 // Option defines a function type that modifies the Config.
@@ -61,6 +74,78 @@ func WithKeyFile(keyFile string) Option {
 	}
 }
 
+// WithMetricsAddr sets the address to serve Prometheus metrics on at /metrics.
+func WithMetricsAddr(addr string) Option {
+	return func(cfg *Config) {
+		cfg.MetricsAddr = addr
+	}
+}
+
+// WithAdminAddr sets the address to serve the admin HTTP API on, which
+// releases barriers for tests that cannot call the Go API.
+func WithAdminAddr(addr string) Option {
+	return func(cfg *Config) {
+		cfg.AdminAddr = addr
+	}
+}
+
+// WithOTLPEndpoint exports a span for every proxied command to the OTLP/HTTP
+// collector at endpoint, e.g. "localhost:4318".
+func WithOTLPEndpoint(endpoint string) Option {
+	return func(cfg *Config) {
+		cfg.OTLPEndpoint = endpoint
+	}
+}
+
+// WithTail prints every OP_MSG command and reply passing through the proxy,
+// filtered according to opts.
+func WithTail(opts TailOptions) Option {
+	return func(cfg *Config) {
+		cfg.Tail = &opts
+	}
+}
+
+// WithPcapFile captures every wire message, in both directions and on every
+// connection, to a pcapng file at path that Wireshark can open.
+func WithPcapFile(path string) Option {
+	return func(cfg *Config) {
+		cfg.PcapFile = path
+	}
+}
+
+// WithHooks sets the callbacks fired as traffic passes through the proxy.
+func WithHooks(hooks Hooks) Option {
+	return func(cfg *Config) {
+		cfg.Hooks = hooks
+	}
+}
+
+// WithTestKeys sets the command fields test instructions are read from,
+// instead of proxyTest. Chained proxies given different keys each act on
+// their own instructions and pass the others on.
+func WithTestKeys(keys ...string) Option {
+	return func(cfg *Config) {
+		cfg.TestKeys = keys
+	}
+}
+
+// WithKeepTestKeys forwards the test instruction fields to the server instead
+// of removing them, for debugging.
+func WithKeepTestKeys(keep bool) Option {
+	return func(cfg *Config) {
+		cfg.KeepTestKeys = keep
+	}
+}
+
+// WithCommentInstructions also reads test instructions from the command's
+// comment, for clients that refuse to send unknown fields but pass comments
+// through.
+func WithCommentInstructions(enabled bool) Option {
+	return func(cfg *Config) {
+		cfg.CommentInstructions = enabled
+	}
+}
+
 // resolveTarget chooses between plain host:port or parses a Mongo URI.
 //
 // TODO: Likely for the SRV solution to work we will need to perform hello
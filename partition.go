@@ -0,0 +1,253 @@
+package mongoproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// partitionMode is the simulated state of the network between clients and
+// the proxy.
+type partitionMode int
+
+const (
+	partitionNone      partitionMode = iota // traffic flows
+	partitionBlackhole                      // connections stay open but nothing flows
+	partitionDown                           // connections are dropped and new ones refused
+)
+
+func (m partitionMode) String() string {
+	switch m {
+	case partitionBlackhole:
+		return "blackhole"
+	case partitionDown:
+		return "down"
+	default:
+		return "healthy"
+	}
+}
+
+// network holds a proxy's partition state. The zero value is a healthy
+// network.
+type network struct {
+	mu     sync.Mutex
+	mode   partitionMode
+	healed chan struct{}      // closed when the current blackhole ends
+	stop   context.CancelFunc // ends the timer or flap driving the current state
+}
+
+// partitionSpec is a partition requested by a proxyTest action or a scenario
+// phase.
+type partitionSpec struct {
+	Mode       string `bson:"mode"`                 // blackhole, drop or flap
+	DurationMs int    `bson:"durationMs,omitempty"` // how long it lasts; 0 until healed
+	UpMs       int    `bson:"upMs,omitempty"`       // flap: time up in each period
+	DownMs     int    `bson:"downMs,omitempty"`     // flap: time down in each period
+}
+
+// String describes the partition, e.g. "blackhole for 5000ms".
+func (s *partitionSpec) String() string {
+	out := s.Mode
+	if s.Mode == "flap" {
+		out += fmt.Sprintf(" up %dms down %dms", s.UpMs, s.DownMs)
+	}
+	if s.DurationMs > 0 {
+		out += fmt.Sprintf(" for %dms", s.DurationMs)
+	}
+	return out
+}
+
+// validate checks the spec's mode and timings.
+func (s *partitionSpec) validate() error {
+	switch s.Mode {
+	case "blackhole", "drop":
+	case "flap":
+		if s.UpMs <= 0 || s.DownMs <= 0 {
+			return fmt.Errorf("flap needs positive upMs and downMs")
+		}
+	default:
+		return fmt.Errorf("unknown partition mode %q", s.Mode)
+	}
+	if s.DurationMs < 0 {
+		return fmt.Errorf("durationMs must not be negative")
+	}
+	return nil
+}
+
+// Blackhole stops all traffic through the proxy for d, or until Heal if d is
+// zero. Connections stay open, so clients only notice through timeouts, and
+// messages sent meanwhile are delivered once the network heals, as TCP would.
+func (p *Proxy) Blackhole(d time.Duration) {
+	p.partition(partitionBlackhole, d)
+}
+
+// Partition drops every connection and refuses new ones for d, or until Heal
+// if d is zero.
+func (p *Proxy) Partition(d time.Duration) {
+	p.partition(partitionDown, d)
+}
+
+// Flap alternates between down, as in Partition, and up for d, or until Heal
+// if d is zero. Each cycle starts down.
+func (p *Proxy) Flap(up, down, d time.Duration) {
+	ctx := p.network.replace(p.ctx)
+
+	go func() {
+		var end <-chan time.Time
+		if d > 0 {
+			end = time.After(d)
+		}
+
+		for {
+			p.setPartition(ctx, partitionDown)
+			select {
+			case <-time.After(down):
+			case <-end:
+				p.setPartition(ctx, partitionNone)
+				return
+			case <-ctx.Done():
+				return
+			}
+
+			p.setPartition(ctx, partitionNone)
+			select {
+			case <-time.After(up):
+			case <-end:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Heal ends any partition, blackhole or flap.
+func (p *Proxy) Heal() {
+	p.partition(partitionNone, 0)
+}
+
+// partition switches to mode, switching back after d unless d is zero or
+// another partition replaces this one first.
+func (p *Proxy) partition(mode partitionMode, d time.Duration) {
+	ctx := p.network.replace(p.ctx)
+	p.setPartition(ctx, mode)
+
+	if mode == partitionNone || d <= 0 {
+		return
+	}
+
+	go func() {
+		select {
+		case <-time.After(d):
+			p.setPartition(ctx, partitionNone)
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// applyPartition starts the partition described by spec. For a scenario
+// phase, d overrides the spec's duration.
+func (p *Proxy) applyPartition(spec *partitionSpec, d time.Duration) {
+	if d == 0 {
+		d = time.Duration(spec.DurationMs) * time.Millisecond
+	}
+
+	switch spec.Mode {
+	case "blackhole":
+		p.Blackhole(d)
+	case "drop":
+		p.Partition(d)
+	case "flap":
+		p.Flap(time.Duration(spec.UpMs)*time.Millisecond, time.Duration(spec.DownMs)*time.Millisecond, d)
+	}
+}
+
+// setPartition switches to mode, unless ctx shows that the timer or flap
+// setting it has been replaced.
+func (p *Proxy) setPartition(ctx context.Context, mode partitionMode) {
+	n := &p.network
+
+	n.mu.Lock()
+	if ctx.Err() != nil || n.mode == mode {
+		n.mu.Unlock()
+		return
+	}
+
+	log.Printf("Network is now %s", mode)
+	if n.mode == partitionBlackhole {
+		close(n.healed)
+	}
+	if mode == partitionBlackhole {
+		n.healed = make(chan struct{})
+	}
+	n.mode = mode
+	n.mu.Unlock()
+
+	if mode == partitionDown {
+		p.conns.closeAll()
+	}
+}
+
+// replace ends whatever drives the current state and returns a context for
+// its replacement.
+func (n *network) replace(parent context.Context) context.Context {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stop != nil {
+		n.stop()
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	n.stop = cancel
+	return ctx
+}
+
+// pass blocks while the network is blackholed. It reports whether traffic
+// may flow, which it may not while the network is down or once ctx is done.
+func (n *network) pass(ctx context.Context) bool {
+	for {
+		n.mu.Lock()
+		mode, healed := n.mode, n.healed
+		n.mu.Unlock()
+
+		switch mode {
+		case partitionNone:
+			return true
+		case partitionDown:
+			return false
+		}
+
+		select {
+		case <-healed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// current returns the network's mode.
+func (n *network) current() partitionMode {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.mode
+}
+
+// refusing reports whether new connections should be refused.
+func (n *network) refusing() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.mode == partitionDown
+}
+
+// refuse closes a connection accepted while the network is down, with a
+// reset rather than a graceful close where possible.
+func refuse(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
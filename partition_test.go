@@ -0,0 +1,119 @@
+package mongoproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyBlackhole(t *testing.T) {
+	p := &Proxy{ctx: context.Background()}
+	require.True(t, p.network.pass(context.Background()))
+
+	p.Blackhole(0)
+
+	passed := make(chan bool)
+	go func() {
+		passed <- p.network.pass(context.Background())
+	}()
+
+	select {
+	case <-passed:
+		t.Fatal("traffic should not flow while blackholed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.Heal()
+	require.True(t, <-passed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.Blackhole(0)
+	cancel()
+	require.False(t, p.network.pass(ctx), "closed connections should stop waiting")
+}
+
+func TestProxyBlackholeExpires(t *testing.T) {
+	p := &Proxy{ctx: context.Background()}
+
+	start := time.Now()
+	p.Blackhole(50 * time.Millisecond)
+	require.True(t, p.network.pass(context.Background()))
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestProxyPartition(t *testing.T) {
+	p := &Proxy{ctx: context.Background()}
+
+	client, peer := net.Pipe()
+	server, _ := net.Pipe()
+	p.conns.add(&proxyConn{id: 1, client: client, server: server})
+
+	p.Partition(0)
+	require.True(t, p.network.refusing())
+	require.False(t, p.network.pass(context.Background()))
+
+	_, err := peer.Read(make([]byte, 1))
+	require.Error(t, err, "open connections should be dropped")
+
+	p.Heal()
+	require.False(t, p.network.refusing())
+}
+
+func TestProxyPartitionReplaced(t *testing.T) {
+	p := &Proxy{ctx: context.Background()}
+
+	p.Blackhole(20 * time.Millisecond)
+	p.Partition(0)
+
+	time.Sleep(50 * time.Millisecond)
+	require.True(t, p.network.refusing(), "the blackhole's timer should not heal the partition that replaced it")
+}
+
+func TestProxyFlap(t *testing.T) {
+	p := &Proxy{ctx: context.Background()}
+	p.Flap(20*time.Millisecond, 20*time.Millisecond, 0)
+
+	seen := map[bool]bool{}
+	deadline := time.Now().Add(time.Second)
+	for len(seen) < 2 && time.Now().Before(deadline) {
+		seen[p.network.refusing()] = true
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.Len(t, seen, 2, "the network should go both down and up")
+
+	p.Heal()
+	time.Sleep(50 * time.Millisecond)
+	require.False(t, p.network.refusing(), "Heal should stop the flap")
+}
+
+func TestRefuse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			refuse(conn)
+		}
+	}()
+
+	// The reset may arrive while dialing or on the first read.
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err == nil {
+		defer conn.Close()
+		_, err = conn.Read(make([]byte, 1))
+	}
+	require.Error(t, err)
+}
+
+func TestPartitionSpecValidate(t *testing.T) {
+	require.NoError(t, (&partitionSpec{Mode: "blackhole", DurationMs: 100}).validate())
+	require.NoError(t, (&partitionSpec{Mode: "flap", UpMs: 10, DownMs: 10}).validate())
+	require.Error(t, (&partitionSpec{Mode: "flap"}).validate())
+	require.Error(t, (&partitionSpec{Mode: "sever"}).validate())
+	require.Error(t, (&partitionSpec{Mode: "drop", DurationMs: -1}).validate())
+}
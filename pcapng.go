@@ -0,0 +1,337 @@
+package mongoproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// pcapng block types and options, see
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-03.html
+const (
+	pcapngSectionHeaderBlock        = 0x0A0D0D0A
+	pcapngInterfaceDescriptionBlock = 0x00000001
+	pcapngEnhancedPacketBlock       = 0x00000006
+
+	pcapngByteOrderMagic = 0x1A2B3C4D
+	pcapngLinkTypeEther  = 1
+
+	pcapngOptEndOfOpt = 0
+	pcapngOptComment  = 1
+	pcapngOptShbApp   = 4
+	pcapngOptIfTsres  = 9
+)
+
+// TCP flags used in the synthetic segments.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// maxSegmentPayload keeps each synthetic IPv4/IPv6 packet below the 64KiB
+// length limit; larger wire messages are split across several segments.
+const maxSegmentPayload = 65000
+
+// pcapWriter writes packets to a pcapng file. It is safe for concurrent use
+// by every connection.
+type pcapWriter struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+// newPcapWriter creates path and writes the section header and the single
+// Ethernet interface every packet is recorded on.
+func newPcapWriter(path string) (*pcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pcapng file %q: %w", path, err)
+	}
+
+	pw := &pcapWriter{f: f, w: bufio.NewWriter(f)}
+
+	// Section Header Block: byte-order magic, version 1.0, unknown length.
+	shb := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	shb = appendPcapngOption(shb, pcapngOptShbApp, []byte("mongoproxy"))
+	shb = appendPcapngOption(shb, pcapngOptEndOfOpt, nil)
+
+	// Interface Description Block: Ethernet, no snap length, nanosecond
+	// timestamps.
+	idb := binary.LittleEndian.AppendUint16(nil, pcapngLinkTypeEther)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0)
+	idb = appendPcapngOption(idb, pcapngOptIfTsres, []byte{9})
+	idb = appendPcapngOption(idb, pcapngOptEndOfOpt, nil)
+
+	if err := pw.writeBlock(pcapngSectionHeaderBlock, shb); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := pw.writeBlock(pcapngInterfaceDescriptionBlock, idb); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return pw, nil
+}
+
+// Close flushes and closes the underlying file.
+func (pw *pcapWriter) Close() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if err := pw.w.Flush(); err != nil {
+		pw.f.Close()
+		return err
+	}
+	return pw.f.Close()
+}
+
+// writePacket records one Ethernet frame captured at ts, with an optional
+// comment.
+func (pw *pcapWriter) writePacket(ts time.Time, frame []byte, comment string) error {
+	nanos := uint64(ts.UnixNano())
+
+	epb := binary.LittleEndian.AppendUint32(nil, 0) // interface ID
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(nanos>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(nanos))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(frame))) // captured length
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(frame))) // original length
+	epb = append(epb, frame...)
+	epb = append(epb, make([]byte, pad4(len(frame)))...)
+
+	if comment != "" {
+		epb = appendPcapngOption(epb, pcapngOptComment, []byte(comment))
+		epb = appendPcapngOption(epb, pcapngOptEndOfOpt, nil)
+	}
+
+	return pw.writeBlock(pcapngEnhancedPacketBlock, epb)
+}
+
+// writeBlock frames body with the block type and both total-length fields,
+// then flushes it so the file stays readable while the proxy runs.
+func (pw *pcapWriter) writeBlock(blockType uint32, body []byte) error {
+	total := uint32(12 + len(body))
+
+	block := binary.LittleEndian.AppendUint32(nil, blockType)
+	block = binary.LittleEndian.AppendUint32(block, total)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, total)
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if _, err := pw.w.Write(block); err != nil {
+		return fmt.Errorf("failed to write pcapng block: %w", err)
+	}
+	return pw.w.Flush()
+}
+
+// appendPcapngOption appends a type-length-value option padded to 32 bits.
+func appendPcapngOption(dst []byte, code uint16, value []byte) []byte {
+	dst = binary.LittleEndian.AppendUint16(dst, code)
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(len(value)))
+	dst = append(dst, value...)
+	return append(dst, make([]byte, pad4(len(value)))...)
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+// pcapStream synthesizes the TCP conversation between a client and the
+// target server for one proxied connection.
+type pcapStream struct {
+	pw *pcapWriter
+
+	mu        sync.Mutex
+	client    *net.TCPAddr
+	server    *net.TCPAddr
+	clientSeq uint32 // next sequence number sent by the client
+	serverSeq uint32 // next sequence number sent by the server
+}
+
+// newPcapStream records a TCP handshake between client and server and returns
+// the stream to record the connection's wire messages on.
+func newPcapStream(pw *pcapWriter, client, server net.Addr) *pcapStream {
+	s := &pcapStream{
+		pw:        pw,
+		client:    tcpAddrOrZero(client),
+		server:    tcpAddrOrZero(server),
+		clientSeq: 1000,
+		serverSeq: 5000,
+	}
+
+	now := time.Now()
+	s.segment(now, true, tcpSYN, nil, "")
+	s.segment(now, false, tcpSYN|tcpACK, nil, "")
+	s.segment(now, true, tcpACK, nil, "")
+
+	return s
+}
+
+// clientToServer records a wire message sent by the client.
+func (s *pcapStream) clientToServer(ts time.Time, msg []byte, comment string) {
+	s.message(ts, true, msg, comment)
+}
+
+// serverToClient records a wire message sent by the server.
+func (s *pcapStream) serverToClient(ts time.Time, msg []byte, comment string) {
+	s.message(ts, false, msg, comment)
+}
+
+// close records the client closing the connection.
+func (s *pcapStream) close() {
+	now := time.Now()
+	s.segment(now, true, tcpFIN|tcpACK, nil, "")
+	s.segment(now, false, tcpFIN|tcpACK, nil, "")
+	s.segment(now, true, tcpACK, nil, "")
+}
+
+func (s *pcapStream) message(ts time.Time, fromClient bool, msg []byte, comment string) {
+	for len(msg) > 0 {
+		n := min(len(msg), maxSegmentPayload)
+
+		s.segment(ts, fromClient, tcpPSH|tcpACK, msg[:n], comment)
+		msg = msg[n:]
+		comment = "" // only annotate the first segment
+	}
+}
+
+// segment records a single TCP segment and advances the sender's sequence
+// number past its payload, or by one for SYN and FIN.
+func (s *pcapStream) segment(ts time.Time, fromClient bool, flags byte, payload []byte, comment string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src, dst := s.client, s.server
+	seq, ack := &s.clientSeq, s.serverSeq
+	if !fromClient {
+		src, dst = s.server, s.client
+		seq, ack = &s.serverSeq, s.clientSeq
+	}
+
+	frame := buildFrame(src, dst, *seq, ack, flags, payload)
+	*seq += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		*seq++
+	}
+
+	if err := s.pw.writePacket(ts, frame, comment); err != nil {
+		log.Printf("failed to capture packet: %v", err)
+	}
+}
+
+// buildFrame builds an Ethernet frame carrying an IPv4 or IPv6 packet with a
+// single TCP segment.
+func buildFrame(src, dst *net.TCPAddr, seq, ack uint32, flags byte, payload []byte) []byte {
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // data offset: 5 words, no options
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535) // window
+	tcp = append(tcp, payload...)
+
+	srcIP4, dstIP4 := src.IP.To4(), dst.IP.To4()
+
+	var (
+		frame     []byte
+		etherType uint16
+	)
+
+	if srcIP4 != nil && dstIP4 != nil {
+		etherType = 0x0800
+
+		ip := make([]byte, 20)
+		ip[0] = 0x45 // version 4, header length 5 words
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[8] = 64 // TTL
+		ip[9] = 6  // TCP
+		copy(ip[12:], srcIP4)
+		copy(ip[16:], dstIP4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+		pseudo := pseudoHeaderSum(srcIP4, dstIP4, len(tcp))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudo))
+
+		frame = append(ip, tcp...)
+	} else {
+		etherType = 0x86DD
+
+		srcIP6, dstIP6 := src.IP.To16(), dst.IP.To16()
+		if srcIP6 == nil {
+			srcIP6 = net.IPv6zero
+		}
+		if dstIP6 == nil {
+			dstIP6 = net.IPv6zero
+		}
+
+		ip := make([]byte, 40)
+		ip[0] = 0x60 // version 6
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6  // next header: TCP
+		ip[7] = 64 // hop limit
+		copy(ip[8:], srcIP6)
+		copy(ip[24:], dstIP6)
+
+		pseudo := pseudoHeaderSum(srcIP6, dstIP6, len(tcp))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudo))
+
+		frame = append(ip, tcp...)
+	}
+
+	eth := make([]byte, 14, 14+len(frame))
+	copy(eth[0:], []byte{0x02, 0, 0, 0, 0, 0x02}) // locally administered dst MAC
+	copy(eth[6:], []byte{0x02, 0, 0, 0, 0, 0x01}) // locally administered src MAC
+	binary.BigEndian.PutUint16(eth[12:], etherType)
+
+	return append(eth, frame...)
+}
+
+// pseudoHeaderSum sums the TCP pseudo-header for the checksum.
+func pseudoHeaderSum(src, dst net.IP, tcpLen int) uint32 {
+	var sum uint32
+	for _, ip := range [][]byte{src, dst} {
+		for i := 0; i+1 < len(ip); i += 2 {
+			sum += uint32(ip[i])<<8 | uint32(ip[i+1])
+		}
+	}
+	return sum + 6 + uint32(tcpLen)
+}
+
+// checksum computes the Internet checksum of b, starting from initial.
+func checksum(b []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// tcpAddrOrZero returns addr as a TCP address, or the IPv4 zero address if it
+// is not one.
+func tcpAddrOrZero(addr net.Addr) *net.TCPAddr {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
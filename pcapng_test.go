@@ -0,0 +1,173 @@
+package mongoproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestPcapWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+
+	pw, err := newPcapWriter(path)
+	require.NoError(t, err)
+
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 51000}
+	server := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 27017}
+
+	stream := newPcapStream(pw, client, server)
+	stream.clientToServer(time.Now(), []byte("request"), "")
+	stream.serverToClient(time.Now(), []byte("reply"), "proxyTest: delayMs=10")
+	stream.close()
+
+	require.NoError(t, pw.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var types []uint32
+	for len(data) > 0 {
+		require.GreaterOrEqual(t, len(data), 12)
+
+		blockType := binary.LittleEndian.Uint32(data)
+		total := binary.LittleEndian.Uint32(data[4:])
+		require.Zero(t, total%4, "blocks must be 32-bit aligned")
+		require.Equal(t, total, binary.LittleEndian.Uint32(data[total-4:]), "trailing length must match")
+
+		types = append(types, blockType)
+		data = data[total:]
+	}
+
+	// Section header, interface, 3 handshake segments, 2 messages, 3 close
+	// segments.
+	require.Len(t, types, 10)
+	require.Equal(t, uint32(pcapngSectionHeaderBlock), types[0])
+	require.Equal(t, uint32(pcapngInterfaceDescriptionBlock), types[1])
+	for _, bt := range types[2:] {
+		require.Equal(t, uint32(pcapngEnhancedPacketBlock), bt)
+	}
+}
+
+func TestBuildFrameChecksums(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 27017}
+
+	frame := buildFrame(src, dst, 1, 2, tcpPSH|tcpACK, []byte("hello"))
+	require.Equal(t, uint16(0x0800), binary.BigEndian.Uint16(frame[12:]))
+
+	ip := frame[14:34]
+	require.Zero(t, checksum(ip, 0), "IPv4 header checksum must verify")
+
+	tcp := frame[34:]
+	require.Zero(t, checksum(tcp, pseudoHeaderSum(src.IP.To4(), dst.IP.To4(), len(tcp))),
+		"TCP checksum must verify")
+	require.Equal(t, "hello", string(tcp[20:]))
+}
+
+func TestBuildFrameIPv6(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 27017}
+
+	frame := buildFrame(src, dst, 1, 2, tcpACK, nil)
+	require.Equal(t, uint16(0x86DD), binary.BigEndian.Uint16(frame[12:]))
+	require.Len(t, frame, 14+40+20)
+}
+
+func TestApplyActionsCapturesWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+
+	pw, err := newPcapWriter(path)
+	require.NoError(t, err)
+
+	client, peer := net.Pipe()
+	defer peer.Close()
+
+	received := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(peer)
+		received <- data
+	}()
+
+	pc := newProxyConn(&Proxy{ctx: context.Background(), stats: newMetrics()}, client, nil)
+	pc.capture = newPcapStream(pw,
+		&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 51000},
+		&net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 27017},
+	)
+
+	doc, err := bson.Marshal(bson.D{{Key: "ok", Value: 1}})
+	require.NoError(t, err)
+	reply := buildMsg(1, 2, doc)
+
+	pc.applyActions(reply, inflightCommand{span: noop.Span{}}, []action{
+		{SendBytes: ptr(5)},
+		{SendAll: ptr(true)},
+	}, "proxyTest: sendBytes=5; sendAll")
+	client.Close()
+
+	require.Equal(t, reply, <-received)
+	require.NoError(t, pw.Close())
+
+	packets := capturedPackets(t, path)
+	require.Len(t, packets, 2)
+	require.Equal(t, reply[:5], packets[0].payload)
+	require.Equal(t, "proxyTest: sendBytes=5; sendAll", packets[0].comment)
+	require.Equal(t, reply[5:], packets[1].payload)
+	require.Empty(t, packets[1].comment)
+}
+
+type capturedPacket struct {
+	payload []byte
+	comment string
+}
+
+// capturedPackets returns the IPv4 TCP segments with a payload in the
+// pcapng file at path.
+func capturedPackets(t *testing.T, path string) []capturedPacket {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var packets []capturedPacket
+	for len(data) > 0 {
+		blockType := binary.LittleEndian.Uint32(data)
+		total := binary.LittleEndian.Uint32(data[4:])
+		block := data[:total]
+		data = data[total:]
+
+		if blockType != pcapngEnhancedPacketBlock {
+			continue
+		}
+
+		captured := int(binary.LittleEndian.Uint32(block[20:]))
+		frame := block[28 : 28+captured]
+		if len(frame) == 14+20+20 {
+			continue // no payload
+		}
+
+		packet := capturedPacket{payload: frame[14+20+20:]}
+
+		// Options follow the padded packet data; a comment has code 1.
+		opts := block[28+(captured+3)&^3 : total-4]
+		for len(opts) >= 4 {
+			code := binary.LittleEndian.Uint16(opts)
+			n := int(binary.LittleEndian.Uint16(opts[2:]))
+			if code == 1 {
+				packet.comment = string(opts[4 : 4+n])
+			}
+			opts = opts[4+(n+3)&^3:]
+		}
+
+		packets = append(packets, packet)
+	}
+	return packets
+}
@@ -1,20 +1,31 @@
 package mongoproxy
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"net/url"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/x/bsonx/bsoncore"
 	"go.mongodb.org/mongo-driver/v2/x/mongo/driver/connstring"
 	"go.mongodb.org/mongo-driver/v2/x/mongo/driver/wiremessage"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 const (
@@ -30,9 +41,296 @@ type connInfo struct {
 	addr string                 // resolved target address
 }
 
+// Proxy forwards connections to a target MongoDB server, applying the
+// proxyTest instructions embedded in commands. Create one with New.
+type Proxy struct {
+	cfg    Config
+	target connInfo
+	hooks  Hooks
+	tracer trace.Tracer
+	tp     *sdktrace.TracerProvider // nil unless tracing is enabled
+	tail   *tailer                  // nil unless tailing is enabled
+	pcap   *pcapWriter              // nil unless capturing is enabled
+	stats  *metrics                 // on the proxy's own registry
+	dsl    dslConfig
+
+	barriers barrierSet
+	rules    ruleSet
+	sessions sessionTracker
+	cursors  cursorTracker
+	conns    connSet
+	network  network
+	frozen   gate
+	topology topologyShift
+	faults   faultCounter
+
+	nextRequestID atomic.Int32 // for replies the proxy answers itself
+
+	nextConnID atomic.Int64
+
+	// ctx is canceled by Close, unblocking every connection.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// wg tracks the connections being proxied, so Close can wait for them.
+	wg sync.WaitGroup
+
+	mu            sync.Mutex
+	ln            net.Listener // set by Serve
+	metricsServer *http.Server // set by Serve, nil unless metrics are enabled
+	adminServer   *http.Server // set by Serve, nil unless the admin API is enabled
+}
+
+// inflightCommand describes a command forwarded to the target server that has
+// not been answered yet.
+type inflightCommand struct {
+	requestID int32
+	info      commandInfo
+	name      string     // command name, e.g. "find"
+	ns        string     // namespace, "db" or "db.collection"
+	start     time.Time  // when the command was forwarded
+	span      trace.Span // span covering the command's round trip
+
+	// For the replies after the first of an exhaust stream, such as a
+	// streaming hello's heartbeats, which the server sends unasked.
+	streamed bool
+	stream   []action // overrideHello actions applied to every reply of the stream
+}
+
+// proxyConn holds the state shared by both directions of a proxied
+// connection.
+type proxyConn struct {
+	p      *Proxy
+	id     int64 // unique per proxy, in accept order
+	client net.Conn
+	server net.Conn
+
+	// ctx is canceled when the connection closes.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	capture *pcapStream // nil unless capturing is enabled
+	since   time.Time   // when the connection was accepted
+
+	mu       sync.Mutex
+	inflight map[int32]inflightCommand // keyed by requestID
+	pending  *testInstruction          // applies to the next reply from the server
+	hello    bool                      // whether the handshake has been seen
+	polling  bool                      // whether the last hello reply lacked a topologyVersion
+	meta     ClientMetadata            // from the handshake
+	kind     connKind                  // what the connection is used for
+}
+
+func newProxyConn(p *Proxy, client, server net.Conn) *proxyConn {
+	ctx, cancel := context.WithCancel(p.ctx)
+
+	return &proxyConn{
+		p:        p,
+		id:       p.nextConnID.Add(1),
+		client:   client,
+		server:   server,
+		ctx:      ctx,
+		cancel:   cancel,
+		since:    time.Now(),
+		inflight: make(map[int32]inflightCommand),
+	}
+}
+
+// close closes both sides of the connection, which ends both of its
+// goroutines.
+func (pc *proxyConn) close() {
+	pc.client.Close()
+	pc.server.Close()
+}
+
+// observe records what a command from the client says about the
+// connection: the client metadata of its handshake, and what it is used for.
+// exhaust reports whether the command was sent with exhaustAllowed. It
+// returns both.
+func (pc *proxyConn) observe(name string, doc bson.Raw, exhaust bool) (ClientMetadata, connKind) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if isHello(name) && !pc.hello {
+		pc.hello = true
+		pc.meta = parseClientMetadata(doc)
+
+		pc.p.stats.clientConnectionsActive.WithLabelValues(pc.meta.AppName, pc.meta.DriverName).Inc()
+		log.Printf("connection #%d from %s: %s", pc.id, pc.client.RemoteAddr(), pc.meta)
+
+		return pc.meta, pc.kind
+	}
+
+	if kind := classify(pc.kind, name, doc, exhaust, pc.polling); kind != pc.kind {
+		pc.kind = kind
+		log.Printf("connection #%d is a %s connection", pc.id, kind)
+	}
+
+	return pc.meta, pc.kind
+}
+
+// observeHelloReply records the session timeout of a hello reply to the
+// client, and whether it carried a topologyVersion. Without one, drivers poll
+// instead of streaming.
+func (pc *proxyConn) observeHelloReply(reply bson.Raw) {
+	pc.p.sessions.observeTimeout(reply)
+
+	_, err := reply.LookupErr("topologyVersion")
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.polling = err != nil
+}
+
+// clientMetadata returns what the handshake said about the client, and
+// whether there has been one.
+func (pc *proxyConn) clientMetadata() (ClientMetadata, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return pc.meta, pc.hello
+}
+
+// continueStream expects the server to follow the reply with the given
+// requestID, which answers cmd and was sent with moreToCome, with another
+// reply to cmd. The overrideHello actions of instr apply to that one too.
+func (pc *proxyConn) continueStream(requestID int32, cmd inflightCommand, instr *testInstruction) {
+	next := inflightCommand{
+		requestID: cmd.requestID,
+		info:      cmd.info,
+		name:      cmd.name,
+		ns:        cmd.ns,
+		start:     time.Now(),
+		span:      noop.Span{},
+		streamed:  true,
+	}
+	if instr != nil {
+		for _, act := range instr.Actions {
+			if act.OverrideHello != nil {
+				next.stream = append(next.stream, action{OverrideHello: act.OverrideHello})
+			}
+		}
+	}
+
+	pc.startCommand(requestID, next)
+}
+
+// setPending makes instr apply to the next reply from the server.
+func (pc *proxyConn) setPending(instr *testInstruction) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.pending = instr
+}
+
+// takePending returns and forgets the instruction for the next reply, if
+// there is one.
+func (pc *proxyConn) takePending() *testInstruction {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	instr := pc.pending
+	pc.pending = nil
+	return instr
+}
+
+// onCommand fires the OnCommand hook for a command read from the client, and
+// returns the document to forward in its place.
+func (pc *proxyConn) onCommand(requestID int32, db string, doc bson.Raw) bson.Raw {
+	if pc.p.hooks.OnCommand == nil {
+		return doc
+	}
+
+	replacement := pc.p.hooks.OnCommand(CommandEvent{
+		ConnID:    pc.id,
+		RequestID: requestID,
+		Name:      commandName(doc),
+		Database:  db,
+		Command:   doc,
+	})
+	if replacement == nil {
+		return doc
+	}
+	return replacement
+}
+
+// onReply fires the OnReply hook for the reply to cmd, and returns the wire
+// message to send in its place along with its document.
+func (pc *proxyConn) onReply(responseTo int32, cmd inflightCommand, raw []byte, doc bson.Raw) ([]byte, bson.Raw) {
+	if pc.p.hooks.OnReply == nil {
+		return raw, doc
+	}
+
+	var duration time.Duration
+	if !cmd.start.IsZero() {
+		duration = time.Since(cmd.start)
+	}
+
+	replacement := pc.p.hooks.OnReply(ReplyEvent{
+		ConnID:     pc.id,
+		ResponseTo: responseTo,
+		Name:       cmd.name,
+		Duration:   duration,
+		Reply:      doc,
+	})
+	if replacement == nil {
+		return raw, doc
+	}
+
+	rebuilt, ok := replaceReplyDocument(raw, replacement)
+	if !ok {
+		return raw, doc
+	}
+	return rebuilt, replacement
+}
+
+// writeServer forwards msg to the server, capturing it as sent.
+func (pc *proxyConn) writeServer(msg []byte) {
+	if pc.capture != nil {
+		pc.capture.clientToServer(time.Now(), msg, "")
+	}
+	pc.server.Write(msg)
+}
+
+// writeClient sends msg to the client, capturing it as sent with comment.
+func (pc *proxyConn) writeClient(msg []byte, comment string) {
+	if pc.capture != nil {
+		pc.capture.serverToClient(time.Now(), msg, comment)
+	}
+	pc.client.Write(msg)
+}
+
+// startCommand records that the command with the given requestID has been
+// forwarded to the target server.
+func (pc *proxyConn) startCommand(requestID int32, cmd inflightCommand) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.inflight[requestID] = cmd
+}
+
+// finishCommand returns and forgets the command answered by a reply with the
+// given responseTo.
+func (pc *proxyConn) finishCommand(responseTo int32) (inflightCommand, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	cmd, ok := pc.inflight[responseTo]
+	delete(pc.inflight, responseTo)
+	return cmd, ok
+}
+
 // ListenAndServe starts the proxy on listenAddr (or default) forwarding to
 // targetAddr (or default).
 func ListenAndServe(opts ...Option) error {
+	p, err := New(opts...)
+	if err != nil {
+		return err
+	}
+
+	return p.ListenAndServe()
+}
+
+// New resolves the target server and returns a proxy configured by opts. Call
+// ListenAndServe or Serve to start accepting connections.
+func New(opts ...Option) (*Proxy, error) {
 	cfg := Config{
 		ListenAddr: defaultListenAddr + ":" + defaultListenPort,
 		TargetAddr: defaultTargetAddr + ":" + defaultTargetPort,
@@ -51,7 +349,7 @@ func ListenAndServe(opts ...Option) error {
 	// the precised tls configuration.
 	u, err := url.Parse(targetURI)
 	if err != nil {
-		return fmt.Errorf("failed to parse target URI %q: %v", targetURI, err)
+		return nil, fmt.Errorf("failed to parse target URI %q: %v", targetURI, err)
 	}
 
 	u.Path = "/"
@@ -74,41 +372,209 @@ func ListenAndServe(opts ...Option) error {
 
 	targetCS, err := connstring.Parse(u.String())
 	if err != nil {
-		return fmt.Errorf("failed to parse target connection string %q: %v", u.String(), err)
+		return nil, fmt.Errorf("failed to parse target connection string %q: %v", u.String(), err)
 	}
 
 	targetAddr, err := resolveTarget(targetCS)
 	if err != nil {
-		return fmt.Errorf("failed to resolve target address: %v", err)
+		return nil, fmt.Errorf("failed to resolve target address: %v", err)
+	}
+
+	p := &Proxy{
+		cfg: cfg,
+		target: connInfo{
+			cs:   targetCS,
+			addr: targetAddr,
+		},
+		hooks:  cfg.Hooks,
+		tracer: noopTracer,
+		stats:  newMetrics(),
+		dsl: dslConfig{
+			keys:     cfg.TestKeys,
+			keep:     cfg.KeepTestKeys,
+			comments: cfg.CommentInstructions,
+		},
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	if cfg.OTLPEndpoint != "" {
+		p.tp, err = newTracerProvider(context.Background(), cfg.OTLPEndpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		p.tracer = p.tp.Tracer(tracerName)
 	}
 
-	targetConnInfo := connInfo{
-		cs:   targetCS,
-		addr: targetAddr,
+	if cfg.Tail != nil {
+		p.tail = newTailer(*cfg.Tail)
 	}
 
-	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if cfg.PcapFile != "" {
+		p.pcap, err = newPcapWriter(cfg.PcapFile)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// ListenAndServe listens on the configured address and proxies connections
+// until Close is called.
+func (p *Proxy) ListenAndServe() error {
+	ln, err := net.Listen("tcp", p.cfg.ListenAddr)
 	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %v", cfg.ListenAddr, err)
+		return fmt.Errorf("failed to listen on %s: %v", p.cfg.ListenAddr, err)
+	}
+
+	return p.Serve(ln)
+}
+
+// Serve proxies connections accepted on ln until Close is called, which also
+// closes ln. It fails at once, closing ln, if the metrics or admin address
+// cannot be listened on.
+func (p *Proxy) Serve(ln net.Listener) error {
+	metricsLn, adminLn, err := p.listenHTTP()
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	p.mu.Lock()
+	p.ln = ln
+	p.mu.Unlock()
+
+	log.Printf("Proxy server listening on %s → %s", ln.Addr(), p.target.addr)
+
+	if metricsLn != nil {
+		srv := newMetricsServer(p.stats)
+
+		p.mu.Lock()
+		p.metricsServer = srv
+		p.mu.Unlock()
+
+		go func() {
+			if err := serveMetrics(srv, metricsLn); err != nil {
+				log.Printf("metrics server stopped: %v", err)
+			}
+		}()
 	}
 
-	log.Printf("Proxy server listening on %s → %s", cfg.ListenAddr, targetAddr)
+	if adminLn != nil {
+		srv := p.newAdminServer()
+
+		p.mu.Lock()
+		p.adminServer = srv
+		p.mu.Unlock()
+
+		go func() {
+			if err := serveAdmin(srv, adminLn); err != nil {
+				log.Printf("admin server stopped: %v", err)
+			}
+		}()
+	}
 
 	for {
 		clientConn, err := ln.Accept()
 		if err != nil {
+			if p.ctx.Err() != nil {
+				return nil // closed by Close
+			}
 			return fmt.Errorf("failed to accept connection: %v", err)
 		}
-		go handleConnection(clientConn, targetConnInfo)
+		if p.network.refusing() {
+			p.stats.connectionsRefusedTotal.Inc()
+			refuse(clientConn)
+			continue
+		}
+		p.mu.Lock()
+		if p.ctx.Err() != nil {
+			p.mu.Unlock()
+			clientConn.Close()
+			return nil // closed by Close
+		}
+		p.wg.Add(1)
+		p.mu.Unlock()
+
+		go func() {
+			defer p.wg.Done()
+			p.handleConnection(clientConn)
+		}()
+	}
+}
+
+// listenHTTP listens on the metrics and admin addresses, if they are
+// configured. Either is nil if its address is not.
+func (p *Proxy) listenHTTP() (metricsLn, adminLn net.Listener, err error) {
+	if p.cfg.MetricsAddr != "" {
+		metricsLn, err = net.Listen("tcp", p.cfg.MetricsAddr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to listen for metrics on %s: %v", p.cfg.MetricsAddr, err)
+		}
+	}
+
+	if p.cfg.AdminAddr != "" {
+		adminLn, err = net.Listen("tcp", p.cfg.AdminAddr)
+		if err != nil {
+			if metricsLn != nil {
+				metricsLn.Close()
+			}
+			return nil, nil, fmt.Errorf("failed to listen for the admin API on %s: %v", p.cfg.AdminAddr, err)
+		}
 	}
+
+	return metricsLn, adminLn, nil
 }
 
-func handleConnection(clientConn net.Conn, targetConnInfo connInfo) {
+// Close stops accepting connections, shuts down the metrics and admin servers,
+// unblocks any messages parked on barriers, closes every connection and waits
+// for them to finish, and flushes tracing and capture output.
+func (p *Proxy) Close() error {
+	p.cancel()
+
+	var errs []error
+
+	p.mu.Lock()
+	if p.ln != nil {
+		errs = append(errs, p.ln.Close())
+	}
+	servers := []*http.Server{p.metricsServer, p.adminServer}
+	p.mu.Unlock()
+
+	for _, srv := range servers {
+		if srv != nil {
+			errs = append(errs, srv.Shutdown(context.Background()))
+		}
+	}
+
+	// Connections write to the capture until they finish.
+	p.conns.closeAll()
+	p.wg.Wait()
+
+	if p.tp != nil {
+		errs = append(errs, p.tp.Shutdown(context.Background()))
+	}
+
+	if p.pcap != nil {
+		errs = append(errs, p.pcap.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p *Proxy) handleConnection(clientConn net.Conn) {
 	defer clientConn.Close()
 
+	p.stats.connectionsTotal.Inc()
+	p.stats.connectionsActive.Inc()
+	defer p.stats.connectionsActive.Dec()
+
 	var serverConn net.Conn
 	var err error
 
+	targetConnInfo := p.target
 	targetCS := targetConnInfo.cs
 
 	// Let the driver build a clientoptions for us
@@ -123,42 +589,81 @@ func handleConnection(clientConn net.Conn, targetConnInfo connInfo) {
 	}
 
 	if err != nil {
+		p.stats.upstreamDialFailuresTotal.Inc()
 		log.Printf("failed to dial target %s: %v", targetConnInfo.addr, err)
 		return // <— bail if we can’t reach the real server
 	}
 	defer serverConn.Close()
 
-	// proxy both directions
-	go proxyClientToMongo(clientConn, serverConn)
-	proxyMongoToClient(serverConn, clientConn)
-}
+	pc := newProxyConn(p, clientConn, serverConn)
+	defer pc.cancel()
 
-// pendingMap tracks per-client pending test instructions.
-var pendingMap = &connMap{m: make(map[net.Conn]*testInstruction)}
+	p.conns.add(pc)
+	defer p.conns.remove(pc.id)
+	defer p.cursors.closeConn(pc.id)
 
-type connMap struct {
-	mu sync.Mutex
-	m  map[net.Conn]*testInstruction
-}
+	// Close may have closed every connection before this one was added.
+	if p.ctx.Err() != nil {
+		return
+	}
 
-func (c *connMap) Set(conn net.Conn, instr *testInstruction) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.m[conn] = instr
-}
+	defer func() {
+		if meta, ok := pc.clientMetadata(); ok {
+			p.stats.clientConnectionsActive.WithLabelValues(meta.AppName, meta.DriverName).Dec()
+		}
+	}()
 
-func (c *connMap) Take(conn net.Conn) *testInstruction {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	instr := c.m[conn]
-	delete(c.m, conn)
-	return instr
+	if p.pcap != nil {
+		pc.capture = newPcapStream(p.pcap, clientConn.RemoteAddr(), serverConn.RemoteAddr())
+		defer pc.capture.close()
+	}
+
+	connEvent := ConnEvent{
+		ConnID:     pc.id,
+		ClientAddr: clientConn.RemoteAddr(),
+		ServerAddr: serverConn.RemoteAddr(),
+	}
+	if p.hooks.OnConnect != nil {
+		p.hooks.OnConnect(connEvent)
+	}
+	if p.hooks.OnDisconnect != nil {
+		defer p.hooks.OnDisconnect(connEvent)
+	}
+
+	// proxy both directions
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxyClientToMongo(pc)
+	}()
+	proxyMongoToClient(pc)
+
+	// Wait for the client side too, so nothing is captured after the
+	// connection is.
+	pc.close()
+	<-done
 }
 
 // proxyClientToMongo intercepts OP_MSG, strips proxyTest, and forwards
 // cleaned message.
-func proxyClientToMongo(src net.Conn, dst net.Conn) {
+func proxyClientToMongo(pc *proxyConn) {
+	src, dst := pc.client, pc.server
+
+	// Once the client is gone, half-close the server side too, so the
+	// server sees it and the reply loop ends.
+	defer func() {
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}()
+
 	for {
+		if !pc.p.frozen.wait(pc.ctx) {
+			return
+		}
+
 		raw, err := readWireMessage(src)
 		if err != nil {
 			log.Printf("error reading from client: %v", err)
@@ -166,24 +671,38 @@ func proxyClientToMongo(src net.Conn, dst net.Conn) {
 			return
 		}
 
+		if !pc.p.network.pass(pc.ctx) || !pc.p.frozen.wait(pc.ctx) {
+			pc.close()
+			return
+		}
+
 		// Parse the wire message header.
 		length, requestID, responseTo, opcode, body, ok := wiremessage.ReadHeader(raw)
+		if ok && opcode == wiremessage.OpQuery {
+			if !pc.forwardQuery(raw, requestID) {
+				return // connection closed while parked
+			}
+			continue
+		}
 		if !ok || opcode != wiremessage.OpMsg {
-			dst.Write(raw)
+			pc.p.stats.observeMessage(directionClientToServer, raw, opcode.String(), "")
+			pc.writeServer(raw)
 			continue
 		}
 
 		// Skip the flags and read the body.
 		flags, body, ok := wiremessage.ReadMsgFlags(body)
 		if !ok {
-			dst.Write(raw)
+			pc.p.stats.observeMessage(directionClientToServer, raw, opcode.String(), "")
+			pc.writeServer(raw)
 			continue
 		}
 
 		// Skip the section type and read the body.
 		stype, body, ok := wiremessage.ReadMsgSectionType(body)
 		if !ok || stype != wiremessage.SingleDocument {
-			dst.Write(raw)
+			pc.p.stats.observeMessage(directionClientToServer, raw, opcode.String(), "")
+			pc.writeServer(raw)
 			continue
 		}
 
@@ -191,25 +710,33 @@ func proxyClientToMongo(src net.Conn, dst net.Conn) {
 			doc      []byte
 			rest     []byte
 			instr    *testInstruction
-			cleanDoc []byte
+			cleanDoc bson.Raw
 		)
 
 		if stype == wiremessage.SingleDocument {
 			doc, rest, ok = wiremessage.ReadMsgSectionSingleDocument(body)
 			if ok {
 				// Strip out the proxyTest and capture the instructions.
-				cleanDoc, instr, err = parseProxy(bson.Raw(doc))
+				cleanDoc, instr, err = pc.p.dsl.parse(bson.Raw(doc))
 				if err != nil {
 					log.Printf("error parsing proxyTest: %v", err)
+					pc.p.stats.observeMessage(directionClientToServer, raw, opcode.String(), commandName(bson.Raw(doc)))
 
-					return
-				}
-
-				if instr != nil {
-					pendingMap.Set(src, instr)
+					// The command is not forwarded: whatever it was meant
+					// to test would not happen as intended.
+					if flags&wiremessage.MoreToCome == 0 {
+						pc.answer(inflightCommand{
+							requestID: requestID,
+							name:      commandName(bson.Raw(doc)),
+							start:     time.Now(),
+							span:      noop.Span{},
+						}, invalidProxyTest(err), nil)
+					}
+					continue
 				}
 			} else {
-				dst.Write(raw)
+				pc.p.stats.observeMessage(directionClientToServer, raw, opcode.String(), "")
+				pc.writeServer(raw)
 
 				continue
 			}
@@ -217,6 +744,107 @@ func proxyClientToMongo(src net.Conn, dst net.Conn) {
 			cleanDoc = nil
 		}
 
+		db, _ := cleanDoc.Lookup("$db").StringValueOK()
+		cleanDoc = pc.onCommand(requestID, db, cleanDoc)
+
+		cmdName := commandName(cleanDoc)
+		ns := commandNamespace(cleanDoc)
+		pc.p.stats.observeMessage(directionClientToServer, raw, opcode.String(), cmdName)
+
+		meta, kind := pc.observe(cmdName, cleanDoc, flags&wiremessage.ExhaustAllowed != 0)
+
+		if pc.p.tail != nil {
+			pc.p.tail.request(pc.id, meta.AppName, requestID, cmdName, ns, cleanDoc, len(raw))
+		}
+
+		info := commandInfo{connID: pc.id, requestID: requestID, name: cmdName, doc: cleanDoc, client: meta, connKind: kind}
+		pc.p.sessions.observe(&info)
+
+		switch cmdName {
+		case "endSessions":
+			pc.p.sessions.endSessions(cleanDoc)
+		case "aggregate":
+			info.changeStream = isChangeStream(cleanDoc)
+		case "getMore":
+			info.cursorID, _ = cleanDoc.Lookup("getMore").AsInt64OK()
+			pc.p.cursors.startGetMore(&info)
+		case "killCursors":
+			pc.p.cursors.forget(cursorIDs(cleanDoc)...)
+		}
+
+		if isControlCommand(cmdName, cleanDoc) {
+			pc.answer(inflightCommand{
+				requestID: requestID,
+				info:      info,
+				name:      cmdName,
+				start:     time.Now(),
+				span:      startCommandSpan(pc.p.tracer, cleanDoc, cmdName, requestID, len(raw)),
+			}, pc.p.control(info), nil)
+			continue
+		}
+
+		// Rules armed earlier apply before this command arms its own, so a
+		// command never triggers the rules it carries. Commands sent with
+		// moreToCome get no reply, so they leave armed rules for later
+		// commands and only their own actions apply, to the request.
+		var replyInstr *testInstruction
+		if flags&wiremessage.MoreToCome == 0 {
+			replyInstr = pc.p.replyInstruction(info, instr)
+		} else {
+			pc.p.armInstruction(info, instr)
+			replyInstr = instr
+		}
+
+		cmd := inflightCommand{
+			requestID: requestID,
+			info:      info,
+			name:      cmdName,
+			ns:        ns,
+			start:     time.Now(),
+			span:      startCommandSpan(pc.p.tracer, cleanDoc, cmdName, requestID, len(raw)),
+		}
+
+		// Batches held back by splitBatch are served without asking the
+		// server.
+		if cmdName == "getMore" {
+			if reply, ok := pc.p.cursors.bufferedReply(info.cursorID); ok {
+				pc.answer(cmd, reply, replyInstr)
+				continue
+			}
+		}
+
+		// So are commands with a respond action, unless they expect no
+		// reply.
+		if reply, ok := replyInstr.response(); ok && flags&wiremessage.MoreToCome == 0 {
+			if !pc.holdRequest(cmd, replyInstr) {
+				return // connection closed while parked
+			}
+			pc.fault(cmd, "respond", action{Respond: reply})
+			log.Printf("Answering %s without the server", cmdName)
+			pc.answer(cmd, reply, replyInstr)
+			continue
+		}
+
+		// Commands sent with moreToCome get no reply, so there is nothing to
+		// apply actions to, time or trace.
+		if flags&wiremessage.MoreToCome == 0 {
+			if replyInstr != nil {
+				pc.setPending(replyInstr)
+			}
+			pc.startCommand(requestID, cmd)
+		}
+
+		if replyInstr != nil {
+			if !pc.holdRequest(cmd, replyInstr) {
+				return // connection closed while parked
+			}
+			cleanDoc = pc.rewriteRequest(cmd, replyInstr, cleanDoc)
+		}
+
+		if isHello(cmdName) {
+			cleanDoc = pc.p.topology.lowerRequest(cleanDoc)
+		}
+
 		// Reconstruct the wire message without the proxyTest section.
 		var newLen int32
 		var payload []byte
@@ -233,8 +861,71 @@ func proxyClientToMongo(src net.Conn, dst net.Conn) {
 		buf = wiremessage.AppendMsgSectionType(buf, stype)
 		buf = append(buf, payload...)
 
-		dst.Write(buf)
+		pc.writeServer(buf)
+
+		if flags&wiremessage.MoreToCome != 0 {
+			cmd.span.End()
+		}
+	}
+}
+
+// forwardQuery forwards an OP_QUERY message. Commands sent this way, which
+// in practice means the handshake, are matched against armed rules like
+// OP_MSG commands, though they cannot carry a proxyTest of their own. It
+// reports whether the connection is still usable.
+func (pc *proxyConn) forwardQuery(raw []byte, requestID int32) bool {
+	doc, ok := queryCommand(raw)
+	if !ok {
+		pc.p.stats.observeMessage(directionClientToServer, raw, wiremessage.OpQuery.String(), "")
+		pc.writeServer(raw)
+		return true
+	}
+
+	if replacement := pc.onCommand(requestID, queryDatabase(raw), doc); !bytes.Equal(replacement, doc) {
+		if rebuilt, ok := replaceQueryCommand(raw, replacement); ok {
+			raw, doc = rebuilt, replacement
+		}
+	}
+
+	cmdName := commandName(doc)
+	ns := commandNamespace(doc)
+	pc.p.stats.observeMessage(directionClientToServer, raw, wiremessage.OpQuery.String(), cmdName)
+
+	meta, kind := pc.observe(cmdName, doc, false)
+
+	if pc.p.tail != nil {
+		pc.p.tail.request(pc.id, meta.AppName, requestID, cmdName, ns, doc, len(raw))
+	}
+
+	info := commandInfo{connID: pc.id, requestID: requestID, name: cmdName, doc: doc, client: meta, connKind: kind}
+	replyInstr := pc.p.replyInstruction(info, nil)
+	if replyInstr != nil {
+		pc.setPending(replyInstr)
+	}
+
+	cmd := inflightCommand{
+		requestID: requestID,
+		info:      info,
+		name:      cmdName,
+		ns:        ns,
+		start:     time.Now(),
+		span:      startCommandSpan(pc.p.tracer, doc, cmdName, requestID, len(raw)),
+	}
+	pc.startCommand(requestID, cmd)
+
+	if replyInstr != nil {
+		if !pc.holdRequest(cmd, replyInstr) {
+			return false
+		}
+		if rewritten := pc.rewriteRequest(cmd, replyInstr, doc); !bytes.Equal(rewritten, doc) {
+			if rebuilt, ok := replaceQueryCommand(raw, rewritten); ok {
+				raw = rebuilt
+			}
+		}
 	}
+
+	pc.writeServer(raw)
+	return true
 }
 
 // readWireMessage reads a length-prefixed MongoDB wire message from src.
@@ -253,64 +944,438 @@ func readWireMessage(src io.Reader) ([]byte, error) {
 	return msg, nil
 }
 
-// applyActions processes a sequence of actions on the response buffer.
-func applyActions(buf []byte, dst net.Conn, actions []action) {
+// applyActions processes a sequence of actions on the response buffer for
+// cmd, writing it to the client. The first write is captured with comment.
+func (pc *proxyConn) applyActions(buf []byte, cmd inflightCommand, actions []action, comment string) {
+	write := func(b []byte) {
+		pc.writeClient(b, comment)
+		comment = "" // only annotate the first write
+	}
+
 	offset := 0
 	sendAction := false
 	for _, act := range actions {
 		if act.DelayMs != nil {
-			log.Printf("Delaying %d ms before sending next action", act.DelayMs)
+			pc.fault(cmd, "delayMs", act, attribute.Int("mongoproxy.delay_ms", *act.DelayMs))
+			log.Printf("Delaying %d ms before sending next action", *act.DelayMs)
 			time.Sleep(time.Duration(*act.DelayMs) * time.Millisecond)
 		}
 		if act.SendBytes != nil {
+			pc.fault(cmd, "sendBytes", act,
+				attribute.Int("mongoproxy.send_bytes", *act.SendBytes),
+				attribute.Int("mongoproxy.offset", offset),
+			)
 			log.Printf("Sending %d bytes from offset %d", *act.SendBytes, offset)
 			end := offset + *act.SendBytes
 			if end > len(buf) {
 				end = len(buf)
 			}
-			dst.Write(buf[offset:end])
+			write(buf[offset:end])
 			offset = end
 			sendAction = true
 		}
 		if act.SendAll != nil {
+			pc.fault(cmd, "sendAll", act, attribute.Int("mongoproxy.offset", offset))
 			log.Printf("Sending remaining bytes from offset %d", offset)
-			dst.Write(buf[offset:])
+			write(buf[offset:])
 			offset = len(buf)
 			sendAction = true
 		}
+		if act.Error != nil {
+			pc.fault(cmd, "error", act, attribute.Int("mongoproxy.error_code", int(act.Error.Code)))
+			log.Printf("Replacing reply with error %d", act.Error.Code)
+			if reply, ok := replyDocument(buf); ok {
+				if rebuilt, ok := replaceReplyDocument(buf, act.Error.document(reply)); ok {
+					buf = rebuilt
+					offset = 0
+				}
+			}
+		}
+		if act.StateChangeError != nil {
+			tv := pc.p.topology.bump()
+			pc.fault(cmd, "stateChangeError", act,
+				attribute.Int("mongoproxy.error_code", int(act.StateChangeError.Code)),
+				attribute.Int64("mongoproxy.topology_version", tv.Counter),
+			)
+			log.Printf("Replacing reply with state change error %d at topologyVersion %d", act.StateChangeError.Code, tv.Counter)
+			if reply, ok := replyDocument(buf); ok {
+				doc, err := withTopologyVersion(act.StateChangeError.document(reply), tv)
+				if err != nil {
+					log.Printf("failed to build state change error: %v", err)
+				} else if rebuilt, ok := replaceReplyDocument(buf, doc); ok {
+					buf = rebuilt
+					offset = 0
+				}
+			}
+		}
+		if act.DropReply != nil && *act.DropReply {
+			pc.fault(cmd, "dropReply", act)
+			log.Printf("Dropping reply")
+			return
+		}
+		if act.CloseConnection != nil && *act.CloseConnection {
+			pc.fault(cmd, "closeConnection", act)
+			log.Printf("Closing connection instead of replying")
+			pc.close()
+			return
+		}
+		if act.SplitBatch != nil {
+			pc.fault(cmd, "splitBatch", act, attribute.Int("mongoproxy.batch_size", *act.SplitBatch))
+			log.Printf("Splitting cursor batch into batches of %d", *act.SplitBatch)
+			buf = editReply(buf, func(reply bson.Raw) (bson.Raw, error) {
+				return pc.p.cursors.split(reply, *act.SplitBatch, pc.id)
+			})
+		}
+		if act.StripPostBatchResumeToken != nil && *act.StripPostBatchResumeToken {
+			pc.fault(cmd, "stripPostBatchResumeToken", act)
+			log.Printf("Stripping postBatchResumeToken from reply")
+			buf = editReply(buf, func(reply bson.Raw) (bson.Raw, error) {
+				return removeCursorField(reply, "postBatchResumeToken")
+			})
+		}
+		if act.OverrideHello != nil {
+			pc.fault(cmd, "overrideHello", act)
+			log.Printf("Overriding hello fields %s", act.OverrideHello)
+			buf = editReply(buf, act.OverrideHello.apply)
+		}
+		if act.CorruptServerSignature != nil && *act.CorruptServerSignature {
+			pc.fault(cmd, "corruptServerSignature", act)
+			log.Printf("Corrupting server signature")
+			buf = editReply(buf, func(reply bson.Raw) (bson.Raw, error) {
+				corrupted, found, err := corruptServerSignature(reply)
+				if err == nil && !found {
+					log.Printf("reply has no server signature to corrupt")
+				}
+				return corrupted, err
+			})
+		}
+		if act.DropSpeculativeAuthenticate != nil && *act.DropSpeculativeAuthenticate {
+			pc.fault(cmd, "dropSpeculativeAuthenticate", act)
+			log.Printf("Dropping speculativeAuthenticate from reply")
+			buf = editReply(buf, func(reply bson.Raw) (bson.Raw, error) {
+				return removeKey(reply, "speculativeAuthenticate"), nil
+			})
+		}
+		if act.WriteConcernError != nil {
+			pc.fault(cmd, "writeConcernError", act, attribute.Int("mongoproxy.error_code", int(act.WriteConcernError.Code)))
+			log.Printf("Adding writeConcernError %d to reply", act.WriteConcernError.Code)
+			buf = editReply(buf, func(reply bson.Raw) (bson.Raw, error) {
+				return addWriteConcernError(reply, act.WriteConcernError)
+			})
+		}
+		if len(act.WriteErrors) > 0 {
+			pc.fault(cmd, "writeErrors", act, attribute.Int("mongoproxy.write_errors", len(act.WriteErrors)))
+			log.Printf("Adding %d writeErrors to reply", len(act.WriteErrors))
+			buf = editReply(buf, func(reply bson.Raw) (bson.Raw, error) {
+				return addWriteErrors(reply, act.WriteErrors)
+			})
+		}
+		if len(act.MutateReply) > 0 {
+			pc.fault(cmd, "mutateReply", act, attribute.Int("mongoproxy.mutations", len(act.MutateReply)))
+			log.Printf("Applying %d mutations to reply", len(act.MutateReply))
+			buf = editReply(buf, func(reply bson.Raw) (bson.Raw, error) {
+				return mutateReply(reply, act.MutateReply)
+			})
+		}
+		if act.Corrupt != nil {
+			seed := time.Now().UnixNano()
+			if act.Corrupt.Seed != nil {
+				seed = *act.Corrupt.Seed
+			}
+			pc.fault(cmd, "corrupt", act, attribute.Int64("mongoproxy.seed", seed))
+			log.Printf("Corrupting reply (%s) with seed %d", act.Corrupt, seed)
+			buf = act.Corrupt.apply(buf, seed)
+		}
+		if act.Partition != nil {
+			pc.fault(cmd, "partition", act, attribute.String("mongoproxy.partition", act.Partition.String()))
+			log.Printf("Starting partition: %s", act.Partition)
+			pc.p.applyPartition(act.Partition, 0)
+			if !pc.p.network.pass(pc.ctx) {
+				return // dropped, or closed while blackholed
+			}
+		}
+		if act.Hold != nil {
+			pc.fault(cmd, "hold", act, attribute.String("mongoproxy.barrier", *act.Hold))
+			log.Printf("Holding reply on barrier %q", *act.Hold)
+			if !pc.p.barriers.wait(pc.ctx, *act.Hold, pc.id) {
+				return // connection closed while parked
+			}
+		}
 	}
 	if offset < len(buf) && !sendAction {
-		dst.Write(buf[offset:])
+		write(buf[offset:])
+	}
+}
+
+// answer replies to cmd with doc on the proxy's behalf, without forwarding
+// the command to the server. The reply passes through OnReply like one from
+// the server.
+func (pc *proxyConn) answer(cmd inflightCommand, doc bson.Raw, instr *testInstruction) {
+	defer cmd.span.End()
+
+	raw := buildMsg(pc.p.nextRequestID.Add(1), cmd.requestID, doc)
+	pc.p.stats.observeMessage(directionServerToClient, raw, wiremessage.OpMsg.String(), cmd.name)
+
+	raw, doc = pc.onReply(cmd.requestID, cmd, raw, doc)
+
+	if pc.p.tail != nil {
+		meta, _ := pc.clientMetadata()
+		pc.p.tail.reply(pc.id, meta.AppName, cmd.requestID, cmd, doc, len(raw))
+	}
+
+	if instr == nil {
+		pc.writeClient(raw, "answered by mongoproxy")
+		return
+	}
+
+	pc.applyActions(raw, cmd, instr.Actions, "answered by mongoproxy; proxyTest: "+instr.String())
+}
+
+// replyInstruction arms the rules carried by the command's proxyTest and
+// returns the instruction for its reply: the proxyTest actions followed by
+// those of the first earlier rule that matches. It returns nil if there are
+// none.
+func (p *Proxy) replyInstruction(info commandInfo, instr *testInstruction) *testInstruction {
+	var actions []action
+	if instr != nil {
+		actions = append(actions, instr.Actions...)
+	}
+	actions = append(actions, p.rules.match(info)...)
+
+	p.armInstruction(info, instr)
+
+	if len(actions) == 0 {
+		return nil
+	}
+	return &testInstruction{Actions: actions}
+}
+
+// armInstruction arms the rules carried by the command's proxyTest, if any.
+func (p *Proxy) armInstruction(info commandInfo, instr *testInstruction) {
+	if instr == nil {
+		return
+	}
+	for _, r := range instr.Arm {
+		p.rules.arm(r, info)
+	}
+}
+
+// holdRequest parks the command on the barriers named by the instruction's
+// holdRequest actions, in order, before it is forwarded. It reports whether
+// the command may be forwarded.
+func (pc *proxyConn) holdRequest(cmd inflightCommand, instr *testInstruction) bool {
+	for _, act := range instr.Actions {
+		if act.HoldRequest == nil {
+			continue
+		}
+
+		pc.fault(cmd, "holdRequest", act, attribute.String("mongoproxy.barrier", *act.HoldRequest))
+		log.Printf("Holding request on barrier %q", *act.HoldRequest)
+		if !pc.p.barriers.wait(pc.ctx, *act.HoldRequest, pc.id) {
+			return false
+		}
+	}
+	return true
+}
+
+// rewriteRequest applies the instruction's actions that edit the command,
+// such as removeCompressors, before it is forwarded.
+func (pc *proxyConn) rewriteRequest(cmd inflightCommand, instr *testInstruction, doc bson.Raw) bson.Raw {
+	for _, act := range instr.Actions {
+		if act.RemoveCompressors == nil {
+			continue
+		}
+
+		pc.fault(cmd, "removeCompressors", act)
+		log.Printf("Removing compressors %v from handshake", *act.RemoveCompressors)
+		rewritten, err := removeCompressors(doc, *act.RemoveCompressors)
+		if err != nil {
+			log.Printf("failed to remove compressors: %v", err)
+			continue
+		}
+		doc = rewritten
+	}
+	return doc
+}
+
+// streamInstruction returns the instruction for a reply of an exhaust stream
+// after the first: the stream's overrides, followed by the actions of the
+// first armed rule that matches its command, as if the client had sent it
+// again. It returns nil if there are none.
+func (p *Proxy) streamInstruction(cmd inflightCommand) *testInstruction {
+	actions := append([]action(nil), cmd.stream...)
+
+	for _, act := range p.rules.match(cmd.info) {
+		// A rule that keeps matching would otherwise apply the overrides it
+		// already added to the stream twice.
+		if slices.ContainsFunc(cmd.stream, func(s action) bool { return s.OverrideHello == act.OverrideHello }) {
+			act.OverrideHello = nil
+		}
+		actions = append(actions, act)
+	}
+
+	if len(actions) == 0 {
+		return nil
 	}
+	return &testInstruction{Actions: actions}
 }
 
-// proxyMongoToClient waits for an instruction on a matching connection, applies it to that first reply, then continues.
-func proxyMongoToClient(src net.Conn, dst net.Conn) {
+// cursorReplyInstruction records the cursor batch in reply and adds the
+// actions of any rule that matches on it to instr.
+func (p *Proxy) cursorReplyInstruction(cmd inflightCommand, reply bson.Raw, instr *testInstruction) *testInstruction {
+	id, docsBefore, batchLen, ok := p.cursors.observeReply(reply, cmd.info)
+	if !ok {
+		return instr
+	}
+
+	if cmd.info.name != "getMore" && id != 0 {
+		p.rules.bindCursor(cmd.info.connID, cmd.requestID, id)
+	}
+
+	info := cmd.info
+	info.cursorID = id
+	info.replied = true
+	info.docsBefore = docsBefore
+	info.batchLen = batchLen
+
+	actions := p.rules.matchReply(info)
+	if len(actions) == 0 {
+		return instr
+	}
+
+	if instr == nil {
+		return &testInstruction{Actions: actions}
+	}
+	return &testInstruction{Actions: append(append([]action(nil), instr.Actions...), actions...)}
+}
+
+// editReply rebuilds the reply message buf with its document passed through
+// edit. If the reply cannot be parsed or edited, buf is returned unchanged.
+func editReply(buf []byte, edit func(bson.Raw) (bson.Raw, error)) []byte {
+	reply, ok := replyDocument(buf)
+	if !ok {
+		return buf
+	}
+
+	edited, err := edit(reply)
+	if err != nil {
+		log.Printf("failed to edit reply: %v", err)
+		return buf
+	}
+
+	if rebuilt, ok := replaceReplyDocument(buf, edited); ok {
+		return rebuilt
+	}
+	return buf
+}
+
+// fault records that an action of the given type is being applied to the reply
+// to cmd: it is counted, added to the command's span and reported to the
+// OnFault hook.
+func (pc *proxyConn) fault(cmd inflightCommand, actionType string, act action, attrs ...attribute.KeyValue) {
+	pc.p.stats.faultsTotal.WithLabelValues(actionType).Inc()
+	pc.p.faults.inc(actionType)
+	cmd.span.AddEvent(actionType, trace.WithAttributes(attrs...))
+
+	if pc.p.hooks.OnFault != nil {
+		pc.p.hooks.OnFault(FaultEvent{
+			ConnID:     pc.id,
+			ResponseTo: cmd.requestID,
+			Name:       cmd.name,
+			Action:     actionType,
+			Detail:     act.String(),
+		})
+	}
+}
+
+// proxyMongoToClient forwards replies to the client, applying any pending
+// instruction for the connection to the next reply.
+func proxyMongoToClient(pc *proxyConn) {
+	src, dst := pc.server, pc.client
+
 	for {
+		if !pc.p.frozen.wait(pc.ctx) {
+			break
+		}
+
 		raw, err := readWireMessage(src)
 		if err != nil {
 			log.Printf("error reading from MongoDB: %v", err)
 
-			return
+			break
+		}
+
+		if !pc.p.network.pass(pc.ctx) || !pc.p.frozen.wait(pc.ctx) {
+			break
+		}
+
+		cmd := inflightCommand{span: noop.Span{}}
+
+		_, requestID, responseTo, opcode, _, ok := wiremessage.ReadHeader(raw)
+		if ok {
+			found, exists := pc.finishCommand(responseTo)
+			if exists {
+				cmd = found
+			}
+			// Streamed replies wait on the server rather than answer a request.
+			if exists && !cmd.streamed {
+				latency := time.Since(cmd.start)
+
+				pc.p.stats.commandDuration.WithLabelValues(cmd.name).Observe(latency.Seconds())
+				cmd.span.SetAttributes(
+					attribute.Int("mongoproxy.reply_bytes", len(raw)),
+					attribute.Float64("mongoproxy.server_latency_ms", float64(latency)/float64(time.Millisecond)),
+				)
+			}
+		}
+		pc.p.stats.observeMessage(directionServerToClient, raw, opcode.String(), cmd.name)
+
+		raw = pc.p.topology.raiseReply(raw)
+
+		// The pending instruction is for the reply to the command. The rest of
+		// an exhaust stream keeps its overrides, so a server that pretends to
+		// be another version does so for every heartbeat, and goes through
+		// the rules again.
+		var instr *testInstruction
+		if cmd.streamed {
+			instr = pc.p.streamInstruction(cmd)
+		} else {
+			instr = pc.takePending()
+		}
+
+		doc, isMsg := msgDocument(raw)
+		if isMsg {
+			instr = pc.p.cursorReplyInstruction(cmd, doc, instr)
+		}
+
+		if moreToCome(raw) {
+			pc.continueStream(requestID, cmd, instr)
+		}
+
+		// Replies may also be OP_REPLY, which answers the legacy handshake.
+		if reply, ok := replyDocument(raw); ok {
+			raw, reply = pc.onReply(responseTo, cmd, raw, reply)
+
+			if isHello(cmd.name) {
+				pc.observeHelloReply(reply)
+			}
+
+			if pc.p.tail != nil {
+				meta, _ := pc.clientMetadata()
+				pc.p.tail.reply(pc.id, meta.AppName, responseTo, cmd, reply, len(raw))
+			}
 		}
 
-		instr := pendingMap.Take(dst)
 		if instr == nil {
 			// Not our target reply yet
-			dst.Write(raw)
+			pc.writeClient(raw, "")
+			cmd.span.End()
 			continue
 		}
 
 		// Apply actions to the raw reply
-		applyActions(raw, dst, instr.Actions)
-		break
-	}
-
-	// Forward remaining data
-	if _, err := io.Copy(dst, src); err != nil {
-		log.Printf("error forwarding remaining data: %v", err)
-
-		return
+		pc.applyActions(raw, cmd, instr.Actions, "proxyTest: "+instr.String())
+		cmd.span.End()
 	}
 
 	// Half-close write side
@@ -320,3 +1385,146 @@ func proxyMongoToClient(src net.Conn, dst net.Conn) {
 		dst.Close()
 	}
 }
+
+// commandName returns the name of the command in doc, which by convention is
+// its first key.
+func commandName(doc bson.Raw) string {
+	elem, err := doc.IndexErr(0)
+	if err != nil {
+		return ""
+	}
+	return elem.Key()
+}
+
+// commandNamespace returns "db.collection" for commands whose first value
+// names a collection, and "db" for the rest.
+func commandNamespace(doc bson.Raw) string {
+	db, _ := doc.Lookup("$db").StringValueOK()
+
+	elem, err := doc.IndexErr(0)
+	if err != nil {
+		return db
+	}
+	if coll, ok := elem.Value().StringValueOK(); ok {
+		return db + "." + coll
+	}
+	return db
+}
+
+// moreToCome reports whether raw is an OP_MSG with the moreToCome flag set.
+// From the server, that means another reply follows without a request.
+func moreToCome(raw []byte) bool {
+	_, _, _, opcode, body, ok := wiremessage.ReadHeader(raw)
+	if !ok || opcode != wiremessage.OpMsg {
+		return false
+	}
+
+	flags, _, ok := wiremessage.ReadMsgFlags(body)
+	return ok && flags&wiremessage.MoreToCome != 0
+}
+
+// msgDocument returns the body document of an OP_MSG wire message.
+func msgDocument(raw []byte) (bson.Raw, bool) {
+	_, _, _, opcode, body, ok := wiremessage.ReadHeader(raw)
+	if !ok || opcode != wiremessage.OpMsg {
+		return nil, false
+	}
+
+	flags, body, ok := wiremessage.ReadMsgFlags(body)
+	if !ok {
+		return nil, false
+	}
+	if flags&wiremessage.ChecksumPresent != 0 && len(body) >= 4 {
+		body = body[:len(body)-4]
+	}
+
+	// The body section may come before or after any document sequences.
+	for len(body) > 0 {
+		var stype wiremessage.SectionType
+		stype, body, ok = wiremessage.ReadMsgSectionType(body)
+		if !ok {
+			return nil, false
+		}
+
+		switch stype {
+		case wiremessage.SingleDocument:
+			doc, _, ok := wiremessage.ReadMsgSectionSingleDocument(body)
+			return bson.Raw(doc), ok
+		case wiremessage.DocumentSequence:
+			_, _, body, ok = wiremessage.ReadMsgSectionRawDocumentSequence(body)
+			if !ok {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+
+	return nil, false
+}
+
+// replaceMsgDocument rebuilds an OP_MSG wire message with doc as its body
+// section, keeping the header IDs, flags and any document sequences. The
+// checksum, if any, is dropped since it would no longer match.
+func replaceMsgDocument(raw []byte, doc bson.Raw) ([]byte, bool) {
+	_, requestID, responseTo, opcode, body, ok := wiremessage.ReadHeader(raw)
+	if !ok || opcode != wiremessage.OpMsg {
+		return nil, false
+	}
+
+	flags, body, ok := wiremessage.ReadMsgFlags(body)
+	if !ok {
+		return nil, false
+	}
+	if flags&wiremessage.ChecksumPresent != 0 && len(body) >= 4 {
+		body = body[:len(body)-4]
+		flags &^= wiremessage.ChecksumPresent
+	}
+
+	idx, buf := wiremessage.AppendHeaderStart(nil, requestID, responseTo, wiremessage.OpMsg)
+	buf = wiremessage.AppendMsgFlags(buf, flags)
+
+	for len(body) > 0 {
+		var stype wiremessage.SectionType
+		stype, body, ok = wiremessage.ReadMsgSectionType(body)
+		if !ok {
+			return nil, false
+		}
+
+		switch stype {
+		case wiremessage.SingleDocument:
+			_, body, ok = wiremessage.ReadMsgSectionSingleDocument(body)
+			if !ok {
+				return nil, false
+			}
+			buf = wiremessage.AppendMsgSectionType(buf, stype)
+			buf = append(buf, doc...)
+		case wiremessage.DocumentSequence:
+			// Copy the sequence through unchanged: its size prefix covers the
+			// identifier and documents.
+			if len(body) < 4 {
+				return nil, false
+			}
+			size := int(binary.LittleEndian.Uint32(body))
+			if size < 4 || size > len(body) {
+				return nil, false
+			}
+			buf = wiremessage.AppendMsgSectionType(buf, stype)
+			buf = append(buf, body[:size]...)
+			body = body[size:]
+		default:
+			return nil, false
+		}
+	}
+
+	return bsoncore.UpdateLength(buf, idx, int32(len(buf[idx:]))), true
+}
+
+// buildMsg builds an OP_MSG wire message with doc as its body.
+func buildMsg(requestID, responseTo int32, doc bson.Raw) []byte {
+	idx, buf := wiremessage.AppendHeaderStart(nil, requestID, responseTo, wiremessage.OpMsg)
+	buf = wiremessage.AppendMsgFlags(buf, 0)
+	buf = wiremessage.AppendMsgSectionType(buf, wiremessage.SingleDocument)
+	buf = append(buf, doc...)
+	return bsoncore.UpdateLength(buf, idx, int32(len(buf[idx:])))
+}
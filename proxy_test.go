@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,11 +14,22 @@ import (
 	tc "github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/event"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/x/mongo/driver/wiremessage"
 )
 
-func newProxyTestClient(t *testing.T, clientOpts *options.ClientOptions) (*mongo.Client, func()) {
+func newProxyTestClient(t *testing.T, clientOpts *options.ClientOptions, proxyOpts ...Option) (*mongo.Client, func()) {
+	t.Helper()
+
+	client, _, teardown := newProxyTestClientWithProxy(t, clientOpts, proxyOpts...)
+	return client, teardown
+}
+
+// newProxyTestClientWithProxy is newProxyTestClient, but also returns the
+// proxy so tests can drive its Go API.
+func newProxyTestClientWithProxy(t *testing.T, clientOpts *options.ClientOptions, proxyOpts ...Option) (*mongo.Client, *Proxy, func()) {
 	t.Helper()
 	ctx := context.Background()
 
@@ -47,17 +60,12 @@ func newProxyTestClient(t *testing.T, clientOpts *options.ClientOptions) (*mongo
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
 	proxyAddr := ln.Addr().String()
-	ln.Close()
 
 	// 3) Launch proxy in background
-	go func() {
-		ListenAndServe(
-			WithListenAddr(proxyAddr),
-			WithTargetAddr(targetAddr),
-		)
-	}()
-	// give it a moment to bind
-	time.Sleep(300 * time.Millisecond)
+	proxy, err := New(append([]Option{WithTargetAddr(targetAddr)}, proxyOpts...)...)
+	require.NoError(t, err)
+
+	go proxy.Serve(ln)
 
 	// 4) Connect client through proxy
 	uri := fmt.Sprintf("mongodb://%s/?directConnection=true", proxyAddr)
@@ -68,13 +76,14 @@ func newProxyTestClient(t *testing.T, clientOpts *options.ClientOptions) (*mongo
 	client, err := mongo.Connect(clientOpts)
 	require.NoError(t, err)
 
-	// teardown closes client and container
+	// teardown closes client, proxy and container
 	teardown := func() {
 		_ = client.Disconnect(ctx)
+		_ = proxy.Close()
 		_ = mongoC.Terminate(ctx)
 	}
 
-	return client, teardown
+	return client, proxy, teardown
 }
 
 func TestDirectForwarding(t *testing.T) {
@@ -176,3 +185,331 @@ func TestProxyCombinedActions(t *testing.T) {
 	require.GreaterOrEqual(t, elapsed, 150*time.Millisecond,
 		"proxy delay not observed; got %v", elapsed)
 }
+
+// TestProxyHooks verifies that hooks observe commands, replies and faults, and
+// that OnReply can replace a reply.
+func TestProxyHooks(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		commands []string
+		faults   []string
+	)
+
+	hooks := Hooks{
+		OnCommand: func(ev CommandEvent) bson.Raw {
+			mu.Lock()
+			defer mu.Unlock()
+			commands = append(commands, ev.Name)
+			return nil
+		},
+		OnReply: func(ev ReplyEvent) bson.Raw {
+			if ev.Name != "ping" {
+				return nil
+			}
+			reply, _ := bson.Marshal(bson.D{{Key: "ok", Value: 1}, {Key: "hooked", Value: true}})
+			return reply
+		},
+		OnFault: func(ev FaultEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			faults = append(faults, ev.Detail)
+		},
+	}
+
+	client, teardown := newProxyTestClient(t, options.Client().SetMaxPoolSize(1), WithHooks(hooks))
+	defer teardown()
+
+	cmd := bson.D{
+		{Key: "ping", Value: 1},
+		{Key: "proxyTest", Value: bson.D{{Key: "actions", Value: bson.A{bson.D{{Key: "delayMs", Value: 10}}}}}},
+	}
+
+	var res struct {
+		Hooked bool `bson:"hooked"`
+	}
+	err := client.Database("admin").RunCommand(context.Background(), cmd).Decode(&res)
+	require.NoError(t, err)
+	assert.True(t, res.Hooked, "expected OnReply to replace the reply")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Contains(t, commands, "ping")
+	assert.Equal(t, []string{"delayMs=10"}, faults)
+}
+
+// TestProxyHoldAction verifies that a reply parked on a barrier is only
+// delivered once the test releases it.
+func TestProxyHoldAction(t *testing.T) {
+	client, proxy, teardown := newProxyTestClientWithProxy(t, options.Client().SetMaxPoolSize(1))
+	defer teardown()
+
+	cmd := bson.D{
+		{Key: "ping", Value: 1},
+		{Key: "proxyTest", Value: bson.D{{Key: "actions", Value: bson.A{bson.D{{Key: "hold", Value: "ping"}}}}}},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Database("admin").RunCommand(context.Background(), cmd).Err()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, proxy.WaitHeld(ctx, "ping", 1))
+
+	select {
+	case err := <-done:
+		t.Fatalf("reply delivered before release: %v", err)
+	default:
+	}
+
+	proxy.Release("ping")
+	require.NoError(t, <-done)
+}
+
+// TestProxyOverrideHelloStreaming verifies that a server pretending to be
+// another version keeps doing so on every heartbeat of a streaming monitor,
+// not just the first.
+func TestProxyOverrideHelloStreaming(t *testing.T) {
+	client, proxy, teardown := newProxyTestClientWithProxy(t, nil)
+	defer teardown()
+
+	arm := bson.D{
+		{Key: "ping", Value: 1},
+		{Key: "proxyTest", Value: bson.D{{Key: "arm", Value: bson.A{bson.D{
+			{Key: "match", Value: bson.D{{Key: "command", Value: "hello"}, {Key: "appName", Value: "watched"}}},
+			{Key: "actions", Value: bson.A{bson.D{{Key: "overrideHello", Value: bson.D{{Key: "maxWireVersion", Value: 8}}}}}},
+			{Key: "times", Value: -1},
+		}}}}},
+	}
+	require.NoError(t, client.Database("admin").RunCommand(context.Background(), arm).Err())
+
+	var (
+		mu       sync.Mutex
+		versions []int32
+	)
+	monitor := &event.ServerMonitor{
+		ServerHeartbeatSucceeded: func(ev *event.ServerHeartbeatSucceededEvent) {
+			if !ev.Awaited {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			versions = append(versions, ev.Reply.MaxWireVersion)
+		},
+	}
+
+	// The rule matches the streaming hello of the new client's monitor once;
+	// every heartbeat it streams back must keep the override.
+	uri := fmt.Sprintf("mongodb://%s/?directConnection=true", proxy.ln.Addr())
+	watched, err := mongo.Connect(options.Client().
+		ApplyURI(uri).
+		SetAppName("watched").
+		SetHeartbeatInterval(500 * time.Millisecond).
+		SetServerMonitor(monitor))
+	require.NoError(t, err)
+	defer watched.Disconnect(context.Background())
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(versions) >= 3
+	}, 10*time.Second, 50*time.Millisecond, "expected several streamed heartbeats")
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, v := range versions {
+		require.Equal(t, int32(8), v, "heartbeat %d", i)
+	}
+}
+
+// TestProxyMonitoringRules verifies that rules for monitoring connections
+// apply to every heartbeat, streamed or polled.
+func TestProxyMonitoringRules(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		faults int
+	)
+	hooks := Hooks{
+		OnFault: func(ev FaultEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			faults++
+		},
+	}
+
+	client, proxy, teardown := newProxyTestClientWithProxy(t, nil, WithHooks(hooks))
+	defer teardown()
+
+	arm := bson.D{
+		{Key: "ping", Value: 1},
+		{Key: "proxyTest", Value: bson.D{{Key: "arm", Value: bson.A{
+			bson.D{
+				{Key: "match", Value: bson.D{{Key: "appName", Value: "streamed"}, {Key: "connection", Value: "monitoring"}}},
+				{Key: "actions", Value: bson.A{bson.D{{Key: "delayMs", Value: 1}}}},
+				{Key: "times", Value: -1},
+			},
+			// Without a topologyVersion, the driver polls instead.
+			bson.D{
+				{Key: "match", Value: bson.D{{Key: "command", Value: "hello"}, {Key: "appName", Value: "polled"}}},
+				{Key: "actions", Value: bson.A{bson.D{{Key: "mutateReply", Value: bson.A{
+					bson.D{{Key: "op", Value: "unset"}, {Key: "path", Value: "topologyVersion"}},
+				}}}}},
+				{Key: "times", Value: -1},
+			},
+		}}}},
+	}
+	require.NoError(t, client.Database("admin").RunCommand(context.Background(), arm).Err())
+
+	for _, app := range []string{"streamed", "polled"} {
+		uri := fmt.Sprintf("mongodb://%s/?directConnection=true", proxy.ln.Addr())
+		c, err := mongo.Connect(options.Client().
+			ApplyURI(uri).
+			SetAppName(app).
+			SetHeartbeatInterval(500 * time.Millisecond))
+		require.NoError(t, err)
+		defer c.Disconnect(context.Background())
+	}
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return faults >= 3
+	}, 10*time.Second, 50*time.Millisecond, "expected the rule to apply to several streamed heartbeats")
+
+	require.Eventually(t, func() bool {
+		for _, conn := range proxy.Connections() {
+			if conn.Client.AppName == "polled" && conn.Kind == kindMonitoring.String() {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 50*time.Millisecond, "expected the polling monitor to be classified as monitoring")
+
+	for _, conn := range proxy.Connections() {
+		if conn.Client.AppName == "polled" {
+			require.NotEqual(t, kindRTT.String(), conn.Kind, "drivers measure round trip times separately only when streaming")
+		}
+	}
+}
+
+func TestProxyCloseShutsDownServers(t *testing.T) {
+	metricsAddr, adminAddr := freeAddr(t), freeAddr(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Proxy{
+		cfg:    Config{MetricsAddr: metricsAddr, AdminAddr: adminAddr},
+		stats:  newMetrics(),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go p.Serve(ln)
+
+	urls := []string{"http://" + metricsAddr + "/metrics", "http://" + adminAddr + "/connections"}
+
+	for _, url := range urls {
+		require.Eventually(t, func() bool {
+			resp, err := http.Get(url)
+			if err != nil {
+				return false
+			}
+			resp.Body.Close()
+			return true
+		}, 5*time.Second, 10*time.Millisecond, url)
+	}
+
+	require.NoError(t, p.Close())
+
+	for _, url := range urls {
+		_, err := http.Get(url)
+		require.Error(t, err, url)
+	}
+}
+
+func TestProxyServeBusyAddr(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	for _, cfg := range []Config{
+		{MetricsAddr: busy.Addr().String()},
+		{MetricsAddr: freeAddr(t), AdminAddr: busy.Addr().String()},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		p := &Proxy{cfg: cfg, stats: newMetrics(), ctx: ctx, cancel: cancel}
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		require.ErrorContains(t, p.Serve(ln), busy.Addr().String())
+
+		_, err = ln.Accept()
+		require.Error(t, err, "Serve closes ln when it fails")
+
+		if cfg.MetricsAddr != busy.Addr().String() {
+			metricsLn, err := net.Listen("tcp", cfg.MetricsAddr)
+			require.NoError(t, err, "the metrics address is released")
+			metricsLn.Close()
+		}
+		cancel()
+	}
+}
+
+// freeAddr returns a local address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+func TestCommandName(t *testing.T) {
+	raw, err := bson.Marshal(bson.D{{Key: "find", Value: "coll"}, {Key: "$db", Value: "test"}})
+	require.NoError(t, err)
+
+	require.Equal(t, "find", commandName(raw))
+	require.Equal(t, "", commandName(nil))
+}
+
+func TestProxyConnInflight(t *testing.T) {
+	pc := newProxyConn(&Proxy{ctx: context.Background(), stats: newMetrics()}, nil, nil)
+	pc.startCommand(7, inflightCommand{name: "insert"})
+
+	cmd, ok := pc.finishCommand(7)
+	require.True(t, ok)
+	require.Equal(t, "insert", cmd.name)
+
+	_, ok = pc.finishCommand(7)
+	require.False(t, ok, "a command should only be finished once")
+}
+
+func TestReplaceMsgDocument(t *testing.T) {
+	raw := buildOpMsg(t, 3, 9, bson.D{{Key: "ok", Value: 1}}, bson.D{{Key: "x", Value: 1}})
+
+	replacement, err := bson.Marshal(bson.D{{Key: "ok", Value: 0}, {Key: "code", Value: 91}})
+	require.NoError(t, err)
+
+	rebuilt, ok := replaceMsgDocument(raw, replacement)
+	require.True(t, ok)
+
+	length, requestID, responseTo, opcode, _, ok := wiremessage.ReadHeader(rebuilt)
+	require.True(t, ok)
+	require.Equal(t, int32(len(rebuilt)), length)
+	require.Equal(t, int32(3), requestID)
+	require.Equal(t, int32(9), responseTo)
+	require.Equal(t, wiremessage.OpMsg, opcode)
+
+	doc, ok := msgDocument(rebuilt)
+	require.True(t, ok)
+	require.Equal(t, bson.Raw(replacement), doc)
+
+	// The document sequence is carried over unchanged.
+	require.Equal(t, raw[len(raw)-30:], rebuilt[len(rebuilt)-30:])
+}
@@ -0,0 +1,80 @@
+package mongoproxy
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// codeNames maps the server error codes most useful in tests to their names,
+// so error actions only need a code.
+var codeNames = map[int32]string{
+	6:     "HostUnreachable",
+	7:     "HostNotFound",
+	11:    "UserNotFound",
+	18:    "AuthenticationFailed",
+	43:    "CursorNotFound",
+	50:    "MaxTimeMSExpired",
+	64:    "WriteConcernFailed",
+	89:    "NetworkTimeout",
+	91:    "ShutdownInProgress",
+	112:   "WriteConflict",
+	136:   "CappedPositionLost",
+	189:   "PrimarySteppedDown",
+	234:   "RetryChangeStream",
+	251:   "NoSuchTransaction",
+	262:   "ExceededTimeLimit",
+	280:   "ChangeStreamFatalError",
+	286:   "ChangeStreamHistoryLost",
+	10107: "NotWritablePrimary",
+	11000: "DuplicateKey",
+	11600: "InterruptedAtShutdown",
+	11602: "InterruptedDueToReplStateChange",
+	13435: "NotPrimaryNoSecondaryOk",
+	13436: "NotPrimaryOrSecondary",
+}
+
+// document builds the error reply. Cluster time fields are copied from the
+// real reply, if any, so clients keep gossiping the right time.
+func (e *errorReply) document(reply bson.Raw) bson.Raw {
+	errmsg := e.Errmsg
+	if errmsg == "" {
+		errmsg = "error injected by mongoproxy"
+	}
+
+	codeName := e.CodeName
+	if codeName == "" {
+		codeName = codeNames[e.Code]
+	}
+
+	doc := bson.D{
+		{Key: "ok", Value: 0.0},
+		{Key: "errmsg", Value: errmsg},
+		{Key: "code", Value: e.Code},
+	}
+	if codeName != "" {
+		doc = append(doc, bson.E{Key: "codeName", Value: codeName})
+	}
+	if len(e.ErrorLabels) > 0 {
+		doc = append(doc, bson.E{Key: "errorLabels", Value: e.ErrorLabels})
+	}
+	doc = append(doc, clusterTime(reply)...)
+
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		// Every value above is marshalable.
+		panic(fmt.Sprintf("failed to marshal error reply: %v", err))
+	}
+	return raw
+}
+
+// clusterTime returns the $clusterTime and operationTime elements of reply.
+func clusterTime(reply bson.Raw) bson.D {
+	var out bson.D
+	for _, key := range []string{"$clusterTime", "operationTime"} {
+		if v, err := reply.LookupErr(key); err == nil {
+			out = append(out, bson.E{Key: key, Value: v})
+		}
+	}
+	return out
+}
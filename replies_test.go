@@ -0,0 +1,36 @@
+package mongoproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestErrorReplyDocument(t *testing.T) {
+	reply, err := bson.Marshal(bson.D{
+		{Key: "ok", Value: 1},
+		{Key: "operationTime", Value: bson.Timestamp{T: 10, I: 1}},
+	})
+	require.NoError(t, err)
+
+	e := errorReply{Code: 251, ErrorLabels: []string{"TransientTransactionError"}}
+	doc := e.document(reply)
+
+	var got struct {
+		OK            float64        `bson:"ok"`
+		Code          int32          `bson:"code"`
+		CodeName      string         `bson:"codeName"`
+		Errmsg        string         `bson:"errmsg"`
+		ErrorLabels   []string       `bson:"errorLabels"`
+		OperationTime bson.Timestamp `bson:"operationTime"`
+	}
+	require.NoError(t, bson.Unmarshal(doc, &got))
+
+	require.Equal(t, 0.0, got.OK)
+	require.Equal(t, int32(251), got.Code)
+	require.Equal(t, "NoSuchTransaction", got.CodeName)
+	require.NotEmpty(t, got.Errmsg)
+	require.Equal(t, []string{"TransientTransactionError"}, got.ErrorLabels)
+	require.Equal(t, bson.Timestamp{T: 10, I: 1}, got.OperationTime)
+}
@@ -0,0 +1,275 @@
+package mongoproxy
+
+import (
+	"slices"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// commandInfo is what rules can match a command on.
+type commandInfo struct {
+	connID    int64
+	requestID int32
+	name      string
+	doc       bson.Raw
+
+	lsid         string // session ID, empty outside a session
+	txnNumber    int64  // transaction number, 0 outside a transaction
+	inTxn        bool   // part of a multi-statement transaction
+	txnStatement int    // position of the statement in its transaction, from 1
+
+	cursorID int64 // cursor of a getMore, or opened by the reply
+	getMoreN int   // position of a getMore on its cursor, from 1
+
+	changeStream bool // opens or continues a change stream
+
+	client   ClientMetadata // from the connection's handshake
+	connKind connKind       // what the connection is used for
+
+	// Set once the reply has been read.
+	replied    bool
+	docsBefore int // documents the cursor returned before this batch
+	batchLen   int // documents in this batch
+}
+
+// armedRule is a rule waiting for matching commands.
+type armedRule struct {
+	rule
+	lsid      string // session of the arming command
+	txnNumber int64  // transaction of the arming command
+	remaining int    // matches left; negative for unlimited
+
+	scope string // set for rules armed by a scenario phase, to disarm them by
+
+	originConn    int64 // connection of the arming command
+	originRequest int32 // request ID of the arming command
+	cursorID      int64 // cursor opened by the arming command, once known
+}
+
+// ruleSet holds the rules armed on a proxy. The zero value is ready to use.
+type ruleSet struct {
+	mu    sync.Mutex
+	rules []*armedRule // in arming order
+}
+
+// arm adds r, scoped by the command that armed it.
+func (rs *ruleSet) arm(r rule, origin commandInfo) {
+	rs.add(r, origin, "")
+}
+
+// armScoped adds r under the given scope, until disarm is called with it.
+func (rs *ruleSet) armScoped(r rule, scope string) {
+	rs.add(r, commandInfo{}, scope)
+}
+
+// disarm removes every rule armed under scope.
+func (rs *ruleSet) disarm(scope string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	kept := rs.rules[:0]
+	for _, ar := range rs.rules {
+		if ar.scope != scope {
+			kept = append(kept, ar)
+		}
+	}
+	rs.rules = kept
+}
+
+func (rs *ruleSet) add(r rule, origin commandInfo, scope string) {
+	remaining := 1
+	if r.Times != nil {
+		remaining = *r.Times
+	}
+	if remaining == 0 {
+		return
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.rules = append(rs.rules, &armedRule{
+		rule:          r,
+		lsid:          origin.lsid,
+		txnNumber:     origin.txnNumber,
+		remaining:     remaining,
+		scope:         scope,
+		originConn:    origin.connID,
+		originRequest: origin.requestID,
+	})
+}
+
+// armedRuleStatus describes an armed rule for proxyStatus.
+type armedRuleStatus struct {
+	Match     ruleMatch `bson:"match"`
+	Actions   []action  `bson:"actions"`
+	Remaining int       `bson:"remaining"` // negative for unlimited
+	Scope     string    `bson:"scope,omitempty"`
+}
+
+// list describes the armed rules, in arming order.
+func (rs *ruleSet) list() []armedRuleStatus {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	out := make([]armedRuleStatus, len(rs.rules))
+	for i, ar := range rs.rules {
+		out[i] = armedRuleStatus{Match: ar.Match, Actions: ar.Actions, Remaining: ar.remaining, Scope: ar.scope}
+	}
+	return out
+}
+
+// reset disarms every rule and returns how many there were.
+func (rs *ruleSet) reset() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	n := len(rs.rules)
+	rs.rules = nil
+	return n
+}
+
+// bindCursor ties the sameCursor rules armed by a command to the cursor its
+// reply opened.
+func (rs *ruleSet) bindCursor(connID int64, requestID int32, cursorID int64) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, ar := range rs.rules {
+		if ar.originConn == connID && ar.originRequest == requestID && ar.cursorID == 0 {
+			ar.cursorID = cursorID
+		}
+	}
+}
+
+// match returns the actions of the first armed rule matching the command in
+// info, using up one of its matches. Rules that depend on the reply are left
+// for matchReply.
+func (rs *ruleSet) match(info commandInfo) []action {
+	return rs.take(info, false)
+}
+
+// matchReply is match for rules that depend on the reply, such as
+// crossesDocCount. info must describe the reply.
+func (rs *ruleSet) matchReply(info commandInfo) []action {
+	return rs.take(info, true)
+}
+
+func (rs *ruleSet) take(info commandInfo, replySide bool) []action {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for i, ar := range rs.rules {
+		if ar.Match.replySide() != replySide || !ar.matches(info) {
+			continue
+		}
+
+		if ar.remaining > 0 {
+			ar.remaining--
+			if ar.remaining == 0 {
+				rs.rules = append(rs.rules[:i], rs.rules[i+1:]...)
+			}
+		}
+		return ar.Actions
+	}
+
+	return nil
+}
+
+func (ar *armedRule) matches(info commandInfo) bool {
+	m := ar.Match
+
+	if m.Command != nil && !commandMatches(*m.Command, info.name) {
+		return false
+	}
+
+	if len(m.Commands) > 0 && !slices.ContainsFunc(m.Commands, func(name string) bool {
+		return commandMatches(name, info.name)
+	}) {
+		return false
+	}
+
+	if m.SameSession != nil && *m.SameSession && (ar.lsid == "" || ar.lsid != info.lsid) {
+		return false
+	}
+
+	if m.InTransaction != nil && *m.InTransaction != info.inTxn {
+		return false
+	}
+
+	if m.TxnStatement != nil && (!info.inTxn || *m.TxnStatement != info.txnStatement) {
+		return false
+	}
+
+	if m.NextTransaction != nil && *m.NextTransaction && (!info.inTxn || info.txnNumber <= ar.txnNumber) {
+		return false
+	}
+
+	if m.CursorID != nil && *m.CursorID != info.cursorID {
+		return false
+	}
+
+	if m.SameCursor != nil && *m.SameCursor && (ar.cursorID == 0 || ar.cursorID != info.cursorID) {
+		return false
+	}
+
+	if m.GetMore != nil && (info.name != "getMore" || *m.GetMore != info.getMoreN) {
+		return false
+	}
+
+	if m.ChangeStream != nil && *m.ChangeStream != info.changeStream {
+		return false
+	}
+
+	if m.Auth != nil && *m.Auth != isAuthCommand(info.name) {
+		return false
+	}
+
+	if m.SpeculativeAuthenticate != nil {
+		_, err := info.doc.LookupErr("speculativeAuthenticate")
+		if *m.SpeculativeAuthenticate != (err == nil) {
+			return false
+		}
+	}
+
+	if m.AppName != nil && *m.AppName != info.client.AppName {
+		return false
+	}
+
+	if m.DriverName != nil && *m.DriverName != info.client.DriverName {
+		return false
+	}
+
+	if m.Connection != nil && *m.Connection != info.connKind.String() {
+		return false
+	}
+
+	if m.Comment != nil {
+		comment, ok := info.doc.Lookup("comment").StringValueOK()
+		if !ok || comment != *m.Comment {
+			return false
+		}
+	}
+
+	if m.CrossesDocCount != nil {
+		n := *m.CrossesDocCount
+		if !info.replied || info.docsBefore >= n || info.docsBefore+info.batchLen < n {
+			return false
+		}
+	}
+
+	return true
+}
+
+// commandMatches reports whether a rule naming the command want matches the
+// command name.
+func commandMatches(want, name string) bool {
+	return want == name || isHello(want) && isHello(name)
+}
+
+// replySide reports whether the match can only be decided once the reply has
+// been read.
+func (m ruleMatch) replySide() bool {
+	return m.CrossesDocCount != nil
+}
@@ -0,0 +1,238 @@
+package mongoproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestRuleSetTimes(t *testing.T) {
+	var rs ruleSet
+
+	rs.arm(rule{
+		Match:   ruleMatch{Command: ptr("ping")},
+		Actions: []action{{DelayMs: ptr(1)}},
+		Times:   ptr(2),
+	}, commandInfo{})
+
+	require.Nil(t, rs.match(commandInfo{name: "find"}))
+	require.Len(t, rs.match(commandInfo{name: "ping"}), 1)
+	require.Len(t, rs.match(commandInfo{name: "ping"}), 1)
+	require.Nil(t, rs.match(commandInfo{name: "ping"}), "rule should be used up")
+}
+
+func TestRuleSetUnlimited(t *testing.T) {
+	var rs ruleSet
+
+	rs.arm(rule{Actions: []action{{DelayMs: ptr(1)}}, Times: ptr(-1)}, commandInfo{})
+
+	for i := 0; i < 5; i++ {
+		require.NotNil(t, rs.match(commandInfo{name: "ping"}))
+	}
+}
+
+func TestRuleSetTransactions(t *testing.T) {
+	var (
+		rs ruleSet
+		st sessionTracker
+	)
+
+	observe := func(info commandInfo) commandInfo {
+		st.observe(&info)
+		return info
+	}
+
+	// Armed during transaction 1 of session 1: fail the commit of the next
+	// transaction on the same session.
+	origin := observe(txnCommand(t, "insert", 1, 1, true))
+	rs.arm(rule{
+		Match: ruleMatch{
+			Command:         ptr("commitTransaction"),
+			SameSession:     ptr(true),
+			NextTransaction: ptr(true),
+		},
+		Actions: []action{{DropReply: ptr(true)}},
+	}, origin)
+
+	require.Nil(t, rs.match(observe(txnCommand(t, "commitTransaction", 1, 1, false))), "same transaction")
+	require.Nil(t, rs.match(observe(txnCommand(t, "commitTransaction", 2, 5, false))), "other session")
+
+	observe(txnCommand(t, "insert", 1, 2, true))
+	require.NotNil(t, rs.match(observe(txnCommand(t, "commitTransaction", 1, 2, false))))
+}
+
+func TestRuleSetTxnStatement(t *testing.T) {
+	var (
+		rs ruleSet
+		st sessionTracker
+	)
+
+	rs.arm(rule{
+		Match:   ruleMatch{TxnStatement: ptr(2)},
+		Actions: []action{{Error: &errorReply{Code: 112}}},
+	}, commandInfo{})
+
+	first := txnCommand(t, "insert", 1, 1, true)
+	st.observe(&first)
+	require.Nil(t, rs.match(first))
+
+	second := txnCommand(t, "insert", 1, 1, false)
+	st.observe(&second)
+	require.NotNil(t, rs.match(second))
+}
+
+func TestRuleSetCursors(t *testing.T) {
+	var rs ruleSet
+
+	// Armed by a find: close the connection on the second getMore of the
+	// cursor it opens.
+	rs.arm(rule{
+		Match:   ruleMatch{SameCursor: ptr(true), GetMore: ptr(2)},
+		Actions: []action{{CloseConnection: ptr(true)}},
+	}, commandInfo{connID: 1, requestID: 10, name: "find"})
+
+	getMore := func(id int64, n int) commandInfo {
+		return commandInfo{connID: 1, name: "getMore", cursorID: id, getMoreN: n}
+	}
+
+	require.Nil(t, rs.match(getMore(42, 2)), "cursor not bound yet")
+
+	rs.bindCursor(1, 10, 42)
+	require.Nil(t, rs.match(getMore(42, 1)))
+	require.Nil(t, rs.match(getMore(7, 2)), "other cursor")
+	require.NotNil(t, rs.match(getMore(42, 2)))
+}
+
+func TestRuleSetCrossesDocCount(t *testing.T) {
+	var rs ruleSet
+
+	rs.arm(rule{
+		Match:   ruleMatch{CrossesDocCount: ptr(150)},
+		Actions: []action{{Error: &errorReply{Code: 43}}},
+	}, commandInfo{})
+
+	batch := func(before, n int) commandInfo {
+		return commandInfo{name: "getMore", replied: true, docsBefore: before, batchLen: n}
+	}
+
+	require.Nil(t, rs.match(batch(100, 101)), "reply-side rules are not matched on the request")
+	require.Nil(t, rs.matchReply(batch(0, 101)))
+	require.Nil(t, rs.matchReply(batch(150, 101)))
+	require.NotNil(t, rs.matchReply(batch(101, 101)))
+}
+
+func TestRuleSetChangeStream(t *testing.T) {
+	var rs ruleSet
+
+	rs.arm(rule{
+		Match:   ruleMatch{Command: ptr("getMore"), ChangeStream: ptr(true)},
+		Actions: []action{{Error: &errorReply{Code: 6}}},
+	}, commandInfo{})
+
+	require.Nil(t, rs.match(commandInfo{name: "getMore", cursorID: 7}))
+	require.NotNil(t, rs.match(commandInfo{name: "getMore", cursorID: 42, changeStream: true}))
+}
+
+func TestRuleSetHello(t *testing.T) {
+	var rs ruleSet
+
+	rs.arm(rule{
+		Match:   ruleMatch{Command: ptr("hello")},
+		Actions: []action{{OverrideHello: &helloOverrides{MaxWireVersion: ptr(int32(7))}}},
+		Times:   ptr(-1),
+	}, commandInfo{})
+
+	require.Nil(t, rs.match(commandInfo{name: "ping"}))
+	for _, name := range []string{"hello", "isMaster", "ismaster"} {
+		require.NotNil(t, rs.match(commandInfo{name: name}), name)
+	}
+}
+
+func TestRuleSetAuth(t *testing.T) {
+	var rs ruleSet
+
+	rs.arm(rule{
+		Match:   ruleMatch{Auth: ptr(true)},
+		Actions: []action{{Error: &errorReply{Code: 18}}},
+		Times:   ptr(-1),
+	}, commandInfo{})
+	rs.arm(rule{
+		Match:   ruleMatch{SpeculativeAuthenticate: ptr(true)},
+		Actions: []action{{DropSpeculativeAuthenticate: ptr(true)}},
+		Times:   ptr(-1),
+	}, commandInfo{})
+
+	for _, name := range []string{"saslStart", "saslContinue", "authenticate"} {
+		require.NotNil(t, rs.match(commandInfo{name: name}), name)
+	}
+
+	monitor := marshalDoc(t, bson.D{{Key: "hello", Value: 1}})
+	require.Nil(t, rs.match(commandInfo{name: "hello", doc: monitor}))
+
+	handshake := marshalDoc(t, bson.D{
+		{Key: "hello", Value: 1},
+		{Key: "speculativeAuthenticate", Value: bson.D{{Key: "saslStart", Value: 1}}},
+	})
+	require.NotNil(t, rs.match(commandInfo{name: "hello", doc: handshake}))
+}
+
+func TestRuleSetDisarm(t *testing.T) {
+	var rs ruleSet
+
+	rs.arm(rule{Match: ruleMatch{Command: ptr("find")}, Actions: []action{{DelayMs: ptr(1)}}, Times: ptr(-1)}, commandInfo{})
+	rs.armScoped(rule{Match: ruleMatch{Commands: []string{"insert", "update"}}, Actions: []action{{DelayMs: ptr(1)}}, Times: ptr(-1)}, "phase")
+
+	require.NotNil(t, rs.match(commandInfo{name: "update"}))
+	require.Nil(t, rs.match(commandInfo{name: "delete"}))
+
+	rs.disarm("phase")
+	require.Nil(t, rs.match(commandInfo{name: "update"}))
+	require.NotNil(t, rs.match(commandInfo{name: "find"}), "unscoped rules should be kept")
+}
+
+func TestRuleSetClient(t *testing.T) {
+	var rs ruleSet
+
+	rs.arm(rule{
+		Match:   ruleMatch{Command: ptr("find"), AppName: ptr("reports"), DriverName: ptr("nodejs")},
+		Actions: []action{{Error: &errorReply{Code: 91}}},
+		Times:   ptr(-1),
+	}, commandInfo{})
+
+	require.Nil(t, rs.match(commandInfo{name: "find"}))
+	require.Nil(t, rs.match(commandInfo{name: "find", client: ClientMetadata{AppName: "reports", DriverName: "mongo-go-driver"}}))
+	require.NotNil(t, rs.match(commandInfo{name: "find", client: ClientMetadata{AppName: "reports", DriverName: "nodejs"}}))
+}
+
+func TestRuleSetConnection(t *testing.T) {
+	var rs ruleSet
+
+	rs.arm(rule{
+		Match:   ruleMatch{Command: ptr("hello"), Connection: ptr("rtt")},
+		Actions: []action{{DelayMs: ptr(2000)}},
+		Times:   ptr(-1),
+	}, commandInfo{})
+
+	require.Nil(t, rs.match(commandInfo{name: "hello"}), "handshakes are not classified yet")
+	require.Nil(t, rs.match(commandInfo{name: "hello", connKind: kindMonitoring}))
+	require.NotNil(t, rs.match(commandInfo{name: "hello", connKind: kindRTT}))
+}
+
+func TestRuleSetComment(t *testing.T) {
+	var rs ruleSet
+
+	rs.arm(rule{
+		Match:   ruleMatch{Comment: ptr("stub me")},
+		Actions: []action{{Respond: marshalDoc(t, bson.D{{Key: "ok", Value: 1.0}})}},
+		Times:   ptr(-1),
+	}, commandInfo{})
+
+	require.Nil(t, rs.match(commandInfo{name: "find", doc: marshalDoc(t, bson.D{{Key: "find", Value: "coll"}})}))
+	require.Nil(t, rs.match(commandInfo{name: "find", doc: marshalDoc(t, bson.D{{Key: "find", Value: "coll"}, {Key: "comment", Value: "other"}})}))
+	require.NotNil(t, rs.match(commandInfo{name: "find", doc: marshalDoc(t, bson.D{{Key: "find", Value: "coll"}, {Key: "comment", Value: "stub me"}})}))
+}
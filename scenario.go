@@ -0,0 +1,262 @@
+package mongoproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"gopkg.in/yaml.v3"
+)
+
+// scenario is a scenario file: the proxies to run and the faults to inject
+// over time.
+type scenario struct {
+	Listeners []scenarioListener `bson:"listeners"`
+	Phases    []scenarioPhase    `bson:"phases"`
+}
+
+// scenarioListener is one proxy of a scenario.
+type scenarioListener struct {
+	Listen    string `bson:"listen"`
+	Target    string `bson:"target,omitempty"`
+	TargetURI string `bson:"targetURI,omitempty"`
+	CAFile    string `bson:"caFile,omitempty"`
+	KeyFile   string `bson:"keyFile,omitempty"`
+}
+
+// scenarioPhase is a period of a scenario. Its rules apply to every proxy
+// until the phase ends.
+type scenarioPhase struct {
+	Name            string `bson:"name,omitempty"`
+	Duration        string `bson:"duration,omitempty"` // e.g. "30s"; empty for the last phase to last forever
+	Rules           []rule `bson:"rules,omitempty"`    // times defaults to unlimited
+	DropConnections bool   `bson:"dropConnections,omitempty"`
+
+	Partition *partitionSpec `bson:"partition,omitempty"` // lasts the whole phase
+}
+
+// ValidateScenario checks a scenario file without running it: that it
+// parses, that every field is one the proxy knows, and that its values make
+// sense.
+func ValidateScenario(path string) error {
+	_, err := loadScenario(path)
+	return err
+}
+
+// RunScenario starts a proxy for each listener in the scenario file, plays
+// its phases in order and keeps proxying until ctx is done. opts apply to
+// every proxy, except that the metrics and admin servers and the capture file
+// belong to the first.
+func RunScenario(ctx context.Context, path string, opts ...Option) error {
+	s, err := loadScenario(path)
+	if err != nil {
+		return err
+	}
+
+	proxies := make([]*Proxy, 0, len(s.Listeners))
+	defer func() {
+		for _, p := range proxies {
+			p.Close()
+		}
+	}()
+
+	for i, l := range s.Listeners {
+		popts := append(append([]Option(nil), opts...), l.options()...)
+		if i > 0 {
+			popts = append(popts, func(cfg *Config) {
+				cfg.MetricsAddr = ""
+				cfg.AdminAddr = ""
+				cfg.PcapFile = ""
+			})
+		}
+
+		p, err := New(popts...)
+		if err != nil {
+			return fmt.Errorf("listener %s: %w", l.Listen, err)
+		}
+		proxies = append(proxies, p)
+	}
+
+	errc := make(chan error, len(proxies))
+	for _, p := range proxies {
+		go func() {
+			errc <- p.ListenAndServe()
+		}()
+	}
+
+	go s.play(ctx, proxies)
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errc:
+		return err
+	}
+}
+
+// loadScenario reads, checks and decodes a scenario file. YAML is a
+// superset of JSON, so either works.
+func loadScenario(path string) (*scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario: %w", err)
+	}
+
+	s, err := parseScenario(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// parseScenario decodes a scenario. The file is decoded generically first so
+// unknown fields can be reported, then converted to Extended JSON so the DSL
+// types decode by their bson tags, exactly as they do from a proxyTest.
+func parseScenario(data []byte) (*scenario, error) {
+	var generic any
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario: %w", err)
+	}
+
+	if err := checkFields(generic, reflect.TypeOf(scenario{}), ""); err != nil {
+		return nil, err
+	}
+
+	extJSON, err := json.Marshal(generic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert scenario: %w", err)
+	}
+
+	var s scenario
+	if err := bson.UnmarshalExtJSON(extJSON, false, &s); err != nil {
+		return nil, fmt.Errorf("failed to decode scenario: %w", err)
+	}
+
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// validate checks the values of a decoded scenario.
+func (s *scenario) validate() error {
+	var errs []error
+
+	if len(s.Listeners) == 0 {
+		errs = append(errs, errors.New("listeners: at least one is required"))
+	}
+	for i, l := range s.Listeners {
+		if l.Listen == "" {
+			errs = append(errs, fmt.Errorf("listeners[%d].listen: required", i))
+		}
+		if l.Target != "" && l.TargetURI != "" {
+			errs = append(errs, fmt.Errorf("listeners[%d]: set target or targetURI, not both", i))
+		}
+	}
+
+	for i, phase := range s.Phases {
+		if phase.Duration != "" {
+			if d, err := time.ParseDuration(phase.Duration); err != nil || d < 0 {
+				errs = append(errs, fmt.Errorf("phases[%d].duration: invalid duration %q", i, phase.Duration))
+			}
+		} else if i < len(s.Phases)-1 {
+			errs = append(errs, fmt.Errorf("phases[%d].duration: required except for the last phase", i))
+		}
+		if phase.Partition != nil {
+			if err := phase.Partition.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("phases[%d].partition: %w", i, err))
+			}
+		}
+		for j, r := range phase.Rules {
+			errs = append(errs, r.validate(fmt.Sprintf("phases[%d].rules[%d]", i, j)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// options returns the options that point a proxy at the listener's target.
+func (l scenarioListener) options() []Option {
+	opts := []Option{WithListenAddr(l.Listen)}
+	if l.Target != "" {
+		opts = append(opts, WithTargetAddr(l.Target))
+	}
+	if l.TargetURI != "" {
+		opts = append(opts, WithTargetURI(l.TargetURI))
+	}
+	if l.CAFile != "" {
+		opts = append(opts, WithCAFile(l.CAFile))
+	}
+	if l.KeyFile != "" {
+		opts = append(opts, WithKeyFile(l.KeyFile))
+	}
+	return opts
+}
+
+// play runs the phases in order. A last phase without a duration lasts until
+// ctx is done; otherwise the proxies carry on healthy after it.
+func (s *scenario) play(ctx context.Context, proxies []*Proxy) {
+	for i, phase := range s.Phases {
+		name := phase.Name
+		if name == "" {
+			name = fmt.Sprintf("phase %d", i+1)
+		}
+		scope := fmt.Sprintf("scenario phase %d", i)
+
+		log.Printf("Scenario: starting %s", name)
+		var d time.Duration
+		if phase.Duration != "" {
+			d, _ = time.ParseDuration(phase.Duration)
+		}
+
+		for _, p := range proxies {
+			p.startPhase(phase, scope, d)
+		}
+
+		if phase.Duration == "" && i == len(s.Phases)-1 {
+			<-ctx.Done()
+			return
+		}
+
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return
+		}
+
+		for _, p := range proxies {
+			p.rules.disarm(scope)
+			if phase.Partition != nil {
+				p.Heal()
+			}
+		}
+	}
+
+	log.Printf("Scenario: all phases done")
+}
+
+// startPhase applies the start of a scenario phase, lasting d, to the proxy.
+func (p *Proxy) startPhase(phase scenarioPhase, scope string, d time.Duration) {
+	if phase.DropConnections {
+		n := p.conns.closeAll()
+		log.Printf("Scenario: dropped %d connections", n)
+	}
+
+	if phase.Partition != nil {
+		p.applyPartition(phase.Partition, d)
+	}
+
+	for _, r := range phase.Rules {
+		if r.Times == nil {
+			unlimited := -1
+			r.Times = &unlimited
+		}
+		p.rules.armScoped(r, scope)
+	}
+}
@@ -0,0 +1,132 @@
+package mongoproxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testScenario = `
+listeners:
+  - listen: ":27018"
+    target: localhost:27017
+phases:
+  - name: healthy
+    duration: 30s
+  - name: slow writes
+    duration: 15s
+    rules:
+      - match: { commands: [insert, update, delete] }
+        actions: [{ delayMs: 500 }]
+  - name: drop
+    duration: 0s
+    dropConnections: true
+  - name: healthy
+`
+
+func TestParseScenario(t *testing.T) {
+	s, err := parseScenario([]byte(testScenario))
+	require.NoError(t, err)
+
+	require.Equal(t, []scenarioListener{{Listen: ":27018", Target: "localhost:27017"}}, s.Listeners)
+	require.Len(t, s.Phases, 4)
+	require.Equal(t, "15s", s.Phases[1].Duration)
+	require.Equal(t, []string{"insert", "update", "delete"}, s.Phases[1].Rules[0].Match.Commands)
+	require.Equal(t, 500, *s.Phases[1].Rules[0].Actions[0].DelayMs)
+	require.True(t, s.Phases[2].DropConnections)
+}
+
+func TestParseScenarioJSON(t *testing.T) {
+	s, err := parseScenario([]byte(`{
+		"listeners": [{"listen": ":27018"}],
+		"phases": [{"rules": [{"match": {"command": "find"}, "actions": [{"error": {"code": 91}}]}]}]
+	}`))
+	require.NoError(t, err)
+	require.Equal(t, int32(91), s.Phases[0].Rules[0].Actions[0].Error.Code)
+}
+
+func TestParseScenarioInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "unknown action",
+			data: `{listeners: [{listen: ":1"}], phases: [{rules: [{actions: [{delay: 200}]}]}]}`,
+			want: "phases[0].rules[0].actions[0].delay: unknown field",
+		},
+		{
+			name: "unknown match field",
+			data: `{listeners: [{listen: ":1"}], phases: [{rules: [{match: {cmd: find}, actions: [{dropReply: true}]}]}]}`,
+			want: "phases[0].rules[0].match.cmd: unknown field",
+		},
+		{
+			name: "bad duration",
+			data: `{listeners: [{listen: ":1"}], phases: [{duration: soon}]}`,
+			want: `phases[0].duration: invalid duration "soon"`,
+		},
+		{
+			name: "missing duration",
+			data: `{listeners: [{listen: ":1"}], phases: [{rules: [{actions: [{dropReply: true}]}]}, {}]}`,
+			want: "phases[0].duration: required except for the last phase",
+		},
+		{
+			name: "no listeners",
+			data: `{phases: []}`,
+			want: "listeners: at least one is required",
+		},
+		{
+			name: "no actions",
+			data: `{listeners: [{listen: ":1"}], phases: [{rules: [{match: {command: find}}]}]}`,
+			want: "phases[0].rules[0].actions: at least one is required",
+		},
+		{
+			name: "wrong type",
+			data: `{listeners: [{listen: ":1"}], phases: [{rules: [{actions: [{delayMs: slow}]}]}]}`,
+			want: "failed to decode scenario",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseScenario([]byte(tc.data))
+			require.ErrorContains(t, err, tc.want)
+		})
+	}
+}
+
+func TestValidateScenario(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scenario.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testScenario), 0o600))
+	require.NoError(t, ValidateScenario(path))
+
+	require.Error(t, ValidateScenario(filepath.Join(t.TempDir(), "missing.yaml")))
+}
+
+func TestStartPhase(t *testing.T) {
+	p := &Proxy{}
+
+	p.startPhase(scenarioPhase{Rules: []rule{{
+		Match:   ruleMatch{Command: ptr("insert")},
+		Actions: []action{{DelayMs: ptr(500)}},
+	}}}, "phase 1", 0)
+
+	for i := 0; i < 3; i++ {
+		require.NotNil(t, p.rules.match(commandInfo{name: "insert"}), "phase rules should apply to every match")
+	}
+
+	p.rules.disarm("phase 1")
+	require.Nil(t, p.rules.match(commandInfo{name: "insert"}))
+}
+
+func TestParseScenarioPartition(t *testing.T) {
+	s, err := parseScenario([]byte(`{listeners: [{listen: ":1"}], phases: [{duration: 30s, partition: {mode: flap, upMs: 2000, downMs: 500}}]}`))
+	require.NoError(t, err)
+	require.Equal(t, &partitionSpec{Mode: "flap", UpMs: 2000, DownMs: 500}, s.Phases[0].Partition)
+
+	_, err = parseScenario([]byte(`{listeners: [{listen: ":1"}], phases: [{partition: {mode: sever}}]}`))
+	require.ErrorContains(t, err, `phases[0].partition: unknown partition mode "sever"`)
+}
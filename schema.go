@@ -0,0 +1,125 @@
+package mongoproxy
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// checkFields reports every key in the decoded document v that has no
+// matching field in the struct type t, following nested documents and
+// arrays. Keys are matched against bson tags, so the DSL types in testdsl.go
+// are their own schema. path names v in errors.
+func checkFields(v any, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		fields, ok := asFields(v)
+		if !ok {
+			return nil // a type error, for the decoder to report
+		}
+
+		known := bsonFields(t)
+		var errs []error
+		for _, key := range sortedKeys(fields) {
+			field, ok := known[key]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown field", joinPath(path, key)))
+				continue
+			}
+			errs = append(errs, checkFields(fields[key], field.Type, joinPath(path, key)))
+		}
+		return errors.Join(errs...)
+
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+
+		elems, ok := asElems(v)
+		if !ok {
+			return nil
+		}
+
+		var errs []error
+		for i, elem := range elems {
+			errs = append(errs, checkFields(elem, t.Elem(), fmt.Sprintf("%s[%d]", path, i)))
+		}
+		return errors.Join(errs...)
+
+	default:
+		return nil
+	}
+}
+
+// bsonFields returns the fields of the struct type t by bson key.
+func bsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		key, _, _ := strings.Cut(f.Tag.Get("bson"), ",")
+		if key == "-" {
+			continue
+		}
+		if key == "" {
+			key = strings.ToLower(f.Name)
+		}
+		fields[key] = f
+	}
+	return fields
+}
+
+// asFields returns the fields of a document decoded from YAML, JSON or BSON.
+func asFields(v any) (map[string]any, bool) {
+	switch d := v.(type) {
+	case map[string]any:
+		return d, true
+	case bson.M:
+		return d, true
+	case bson.D:
+		fields := make(map[string]any, len(d))
+		for _, e := range d {
+			fields[e.Key] = e.Value
+		}
+		return fields, true
+	}
+	return nil, false
+}
+
+// asElems returns the elements of an array decoded from YAML, JSON or BSON.
+func asElems(v any) ([]any, bool) {
+	switch a := v.(type) {
+	case []any:
+		return a, true
+	case bson.A:
+		return a, true
+	}
+	return nil, false
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
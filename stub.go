@@ -0,0 +1,41 @@
+package mongoproxy
+
+import (
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/x/bsonx/bsoncore"
+)
+
+// response returns the reply of the instruction's first respond action, if
+// it has one, so the command can be answered without the server.
+func (ti *testInstruction) response() (bson.Raw, bool) {
+	if ti == nil {
+		return nil, false
+	}
+
+	for _, act := range ti.Actions {
+		if act.Respond != nil {
+			return stubReply(act.Respond), true
+		}
+	}
+	return nil, false
+}
+
+// stubReply returns a canned reply with ok: 1 added, unless it says
+// otherwise.
+func stubReply(doc bson.Raw) bson.Raw {
+	if _, err := doc.LookupErr("ok"); err == nil {
+		return doc
+	}
+
+	elems, err := bsoncore.Document(doc).Elements()
+	if err != nil {
+		return doc
+	}
+
+	rawElems := make([][]byte, 0, len(elems)+1)
+	for _, e := range elems {
+		rawElems = append(rawElems, []byte(e))
+	}
+	rawElems = append(rawElems, bsoncore.AppendDoubleElement(nil, "ok", 1))
+	return bson.Raw(bsoncore.BuildDocument(nil, rawElems...))
+}
@@ -0,0 +1,47 @@
+package mongoproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestStubReply(t *testing.T) {
+	reply := stubReply(marshalDoc(t, bson.D{{Key: "version", Value: "4.0.0"}}))
+	require.Equal(t, "4.0.0", reply.Lookup("version").StringValue())
+	require.Equal(t, 1.0, reply.Lookup("ok").Double())
+
+	failure := marshalDoc(t, bson.D{{Key: "ok", Value: 0}, {Key: "code", Value: 59}})
+	require.Equal(t, failure, stubReply(failure), "an explicit ok should be kept")
+}
+
+func TestInstructionResponse(t *testing.T) {
+	var none *testInstruction
+	_, ok := none.response()
+	require.False(t, ok)
+
+	_, ok = (&testInstruction{Actions: []action{{DelayMs: ptr(10)}}}).response()
+	require.False(t, ok)
+
+	canned := marshalDoc(t, bson.D{{Key: "ok", Value: 1.0}})
+	reply, ok := (&testInstruction{Actions: []action{{DelayMs: ptr(10)}, {Respond: canned}}}).response()
+	require.True(t, ok)
+	require.Equal(t, canned, reply)
+}
+
+func TestParseProxyRespond(t *testing.T) {
+	cmd := marshalDoc(t, bson.D{
+		{Key: "buildInfo", Value: 1},
+		{Key: "proxyTest", Value: bson.D{{Key: "actions", Value: bson.A{
+			bson.D{{Key: "respond", Value: bson.D{{Key: "version", Value: "4.0.0"}}}},
+		}}}},
+	})
+
+	_, instr, err := parseProxy(cmd)
+	require.NoError(t, err)
+
+	reply, ok := instr.response()
+	require.True(t, ok)
+	require.Equal(t, "4.0.0", reply.Lookup("version").StringValue())
+}
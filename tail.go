@@ -0,0 +1,162 @@
+package mongoproxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// TailOptions configures the live traffic inspector, which prints every
+// OP_MSG command and reply passing through the proxy.
+type TailOptions struct {
+	Output     io.Writer // Where to print; defaults to os.Stdout
+	Pretty     bool      // Print each document as indented Extended JSON
+	Commands   []string  // Only print these command names, e.g. "find"
+	Namespaces []string  // Only print these namespaces, "db" or "db.collection"
+	ConnIDs    []int64   // Only print these connection IDs
+}
+
+// tailer prints the messages selected by its TailOptions. It is safe for
+// concurrent use by every connection.
+type tailer struct {
+	mu  sync.Mutex
+	out io.Writer
+
+	pretty     bool
+	commands   map[string]bool
+	namespaces map[string]bool
+	connIDs    map[int64]bool
+}
+
+func newTailer(opts TailOptions) *tailer {
+	t := &tailer{
+		out:    opts.Output,
+		pretty: opts.Pretty,
+	}
+
+	if t.out == nil {
+		t.out = os.Stdout
+	}
+
+	if len(opts.Commands) > 0 {
+		t.commands = make(map[string]bool)
+		for _, name := range opts.Commands {
+			t.commands[strings.ToLower(name)] = true
+		}
+	}
+
+	if len(opts.Namespaces) > 0 {
+		t.namespaces = make(map[string]bool)
+		for _, ns := range opts.Namespaces {
+			t.namespaces[ns] = true
+		}
+	}
+
+	if len(opts.ConnIDs) > 0 {
+		t.connIDs = make(map[int64]bool)
+		for _, id := range opts.ConnIDs {
+			t.connIDs[id] = true
+		}
+	}
+
+	return t
+}
+
+// match reports whether a message on connection connID for the given command
+// and namespace passes the filters. A namespace filter of "db" also matches
+// every collection in db.
+func (t *tailer) match(connID int64, cmdName, ns string) bool {
+	if t.connIDs != nil && !t.connIDs[connID] {
+		return false
+	}
+
+	if t.commands != nil && !t.commands[strings.ToLower(cmdName)] {
+		return false
+	}
+
+	if t.namespaces != nil {
+		db, _, _ := strings.Cut(ns, ".")
+		if !t.namespaces[ns] && !t.namespaces[db] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// request prints a command read from the client. app is the client's
+// application name, if it gave one.
+func (t *tailer) request(connID int64, app string, requestID int32, cmdName, ns string, doc bson.Raw, size int) {
+	if !t.match(connID, cmdName, ns) {
+		return
+	}
+
+	header := fmt.Sprintf("%s %s → %s %s req=%d %dB",
+		time.Now().Format("15:04:05.000"), connLabel(connID, app), cmdName, ns, requestID, size)
+
+	t.print(header, doc)
+}
+
+// reply prints a reply read from the server. cmd is the command it answers,
+// or the zero value if the reply could not be matched to one.
+func (t *tailer) reply(connID int64, app string, responseTo int32, cmd inflightCommand, doc bson.Raw, size int) {
+	if !t.match(connID, cmd.name, cmd.ns) {
+		return
+	}
+
+	header := fmt.Sprintf("%s %s ← %s %s resp=%d %dB",
+		time.Now().Format("15:04:05.000"), connLabel(connID, app), cmd.name, cmd.ns, responseTo, size)
+
+	if !cmd.start.IsZero() {
+		header += fmt.Sprintf(" %s", time.Since(cmd.start).Round(time.Microsecond))
+	}
+
+	if ok, err := doc.LookupErr("ok"); err == nil {
+		if n, isNum := ok.AsInt64OK(); isNum && n == 0 {
+			code, _ := doc.Lookup("code").AsInt64OK()
+			errmsg, _ := doc.Lookup("errmsg").StringValueOK()
+			header += fmt.Sprintf(" ok=0 code=%d errmsg=%q", code, errmsg)
+		}
+	}
+
+	t.print(header, doc)
+}
+
+// connLabel names a connection in tail headers, e.g. "#3" or "#3[reports]".
+func connLabel(connID int64, app string) string {
+	if app == "" {
+		return fmt.Sprintf("#%d", connID)
+	}
+	return fmt.Sprintf("#%d[%s]", connID, app)
+}
+
+func (t *tailer) print(header string, doc bson.Raw) {
+	var (
+		body []byte
+		err  error
+	)
+
+	if t.pretty {
+		body, err = bson.MarshalExtJSONIndent(doc, false, false, "", "  ")
+	} else {
+		body, err = bson.MarshalExtJSON(doc, false, false)
+	}
+
+	if err != nil {
+		body = []byte(fmt.Sprintf("<invalid BSON: %v>", err))
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.pretty {
+		fmt.Fprintf(t.out, "%s\n%s\n", header, body)
+	} else {
+		fmt.Fprintf(t.out, "%s %s\n", header, body)
+	}
+}
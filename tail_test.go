@@ -0,0 +1,57 @@
+package mongoproxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestTailerMatch(t *testing.T) {
+	tl := newTailer(TailOptions{
+		Commands:   []string{"find"},
+		Namespaces: []string{"test"},
+		ConnIDs:    []int64{2},
+	})
+
+	require.True(t, tl.match(2, "find", "test.coll"))
+	require.True(t, tl.match(2, "Find", "test"))
+	require.False(t, tl.match(1, "find", "test.coll"), "connection filter")
+	require.False(t, tl.match(2, "insert", "test.coll"), "command filter")
+	require.False(t, tl.match(2, "find", "other.coll"), "namespace filter")
+}
+
+func TestTailerPrint(t *testing.T) {
+	var out bytes.Buffer
+	tl := newTailer(TailOptions{Output: &out})
+
+	doc, err := bson.Marshal(bson.D{{Key: "find", Value: "coll"}, {Key: "$db", Value: "test"}})
+	require.NoError(t, err)
+
+	tl.request(1, "", 5, "find", "test.coll", doc, 42)
+
+	line := out.String()
+	require.True(t, strings.HasSuffix(line, "\n"))
+	require.Contains(t, line, "#1 → find test.coll req=5 42B")
+	require.Contains(t, line, `{"find":"coll","$db":"test"}`)
+
+	out.Reset()
+	tl.request(2, "reports", 6, "find", "test.coll", doc, 42)
+	require.Contains(t, out.String(), "#2[reports] → find test.coll req=6 42B")
+}
+
+func TestMsgDocument(t *testing.T) {
+	raw := buildOpMsg(t, 1, 0, bson.D{{Key: "ok", Value: 1}})
+
+	doc, err := bson.Marshal(bson.D{{Key: "ok", Value: 1}})
+	require.NoError(t, err)
+
+	got, ok := msgDocument(raw)
+	require.True(t, ok)
+	require.Equal(t, bson.Raw(doc), got)
+
+	_, ok = msgDocument(raw[:10])
+	require.False(t, ok, "truncated message")
+}
@@ -1,7 +1,10 @@
 package mongoproxy
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/x/bsonx/bsoncore"
@@ -9,48 +12,400 @@ import (
 
 // action is one step in the proxyTest sequence.
 type action struct {
-	DelayMs   *int  `bson:"delayMs,omitempty"`   // milliseconds to wait
-	SendBytes *int  `bson:"sendBytes,omitempty"` // how many bytes to forward
-	SendAll   *bool `bson:"sendAll,omitempty"`   // forward remaining bytes
+	DelayMs     *int    `bson:"delayMs,omitempty"`     // milliseconds to wait
+	SendBytes   *int    `bson:"sendBytes,omitempty"`   // how many bytes to forward
+	SendAll     *bool   `bson:"sendAll,omitempty"`     // forward remaining bytes
+	Hold        *string `bson:"hold,omitempty"`        // barrier to park the reply on
+	HoldRequest *string `bson:"holdRequest,omitempty"` // barrier to park the command on
+
+	Error           *errorReply `bson:"error,omitempty"`           // answer with this error instead
+	DropReply       *bool       `bson:"dropReply,omitempty"`       // never send the reply
+	CloseConnection *bool       `bson:"closeConnection,omitempty"` // close the connection instead of replying
+	SplitBatch      *int        `bson:"splitBatch,omitempty"`      // cap the cursor batch, serving the rest on later getMores
+
+	StripPostBatchResumeToken *bool `bson:"stripPostBatchResumeToken,omitempty"` // remove the change stream's resume token
+
+	OverrideHello     *helloOverrides `bson:"overrideHello,omitempty"`     // replace fields of a hello reply
+	RemoveCompressors *[]string       `bson:"removeCompressors,omitempty"` // drop compressors the client offers; empty for all
+
+	CorruptServerSignature      *bool `bson:"corruptServerSignature,omitempty"`      // make the SCRAM server signature fail to verify
+	DropSpeculativeAuthenticate *bool `bson:"dropSpeculativeAuthenticate,omitempty"` // remove speculativeAuthenticate from a hello reply
+
+	WriteConcernError *errorReply  `bson:"writeConcernError,omitempty"` // add a writeConcernError to the reply
+	WriteErrors       []writeError `bson:"writeErrors,omitempty"`       // add per-operation writeErrors to the reply
+
+	MutateReply []mutation  `bson:"mutateReply,omitempty"` // edit fields of the reply by path
+	Corrupt     *corruption `bson:"corrupt,omitempty"`     // damage the reply's bytes
+
+	Partition *partitionSpec `bson:"partition,omitempty"` // partition every connection through the proxy
+
+	StateChangeError *errorReply `bson:"stateChangeError,omitempty"` // answer with this error and a newer topologyVersion
+
+	Respond bson.Raw `bson:"respond,omitempty"` // answer with this document without forwarding the command
+}
+
+// errorReply is a server error sent in place of the real reply.
+type errorReply struct {
+	Code        int32    `bson:"code"`
+	CodeName    string   `bson:"codeName,omitempty"`
+	Errmsg      string   `bson:"errmsg,omitempty"`
+	ErrorLabels []string `bson:"errorLabels,omitempty"`
+}
+
+// String describes the action for logs and capture annotations.
+func (a action) String() string {
+	var parts []string
+	if a.DelayMs != nil {
+		parts = append(parts, fmt.Sprintf("delayMs=%d", *a.DelayMs))
+	}
+	if a.SendBytes != nil {
+		parts = append(parts, fmt.Sprintf("sendBytes=%d", *a.SendBytes))
+	}
+	if a.SendAll != nil {
+		parts = append(parts, fmt.Sprintf("sendAll=%t", *a.SendAll))
+	}
+	if a.Hold != nil {
+		parts = append(parts, fmt.Sprintf("hold=%s", *a.Hold))
+	}
+	if a.HoldRequest != nil {
+		parts = append(parts, fmt.Sprintf("holdRequest=%s", *a.HoldRequest))
+	}
+	if a.Error != nil {
+		parts = append(parts, fmt.Sprintf("error=%d", a.Error.Code))
+	}
+	if a.DropReply != nil {
+		parts = append(parts, fmt.Sprintf("dropReply=%t", *a.DropReply))
+	}
+	if a.CloseConnection != nil {
+		parts = append(parts, fmt.Sprintf("closeConnection=%t", *a.CloseConnection))
+	}
+	if a.SplitBatch != nil {
+		parts = append(parts, fmt.Sprintf("splitBatch=%d", *a.SplitBatch))
+	}
+	if a.StripPostBatchResumeToken != nil {
+		parts = append(parts, fmt.Sprintf("stripPostBatchResumeToken=%t", *a.StripPostBatchResumeToken))
+	}
+	if a.OverrideHello != nil {
+		parts = append(parts, fmt.Sprintf("overrideHello=%s", a.OverrideHello))
+	}
+	if a.RemoveCompressors != nil {
+		parts = append(parts, fmt.Sprintf("removeCompressors=%s", strings.Join(*a.RemoveCompressors, ",")))
+	}
+	if a.CorruptServerSignature != nil {
+		parts = append(parts, fmt.Sprintf("corruptServerSignature=%t", *a.CorruptServerSignature))
+	}
+	if a.DropSpeculativeAuthenticate != nil {
+		parts = append(parts, fmt.Sprintf("dropSpeculativeAuthenticate=%t", *a.DropSpeculativeAuthenticate))
+	}
+	if a.WriteConcernError != nil {
+		parts = append(parts, fmt.Sprintf("writeConcernError=%d", a.WriteConcernError.Code))
+	}
+	for _, we := range a.WriteErrors {
+		parts = append(parts, fmt.Sprintf("writeError=%d@%d", we.Code, we.Index))
+	}
+	for _, m := range a.MutateReply {
+		parts = append(parts, fmt.Sprintf("mutateReply=%s", m))
+	}
+	if a.Corrupt != nil {
+		parts = append(parts, fmt.Sprintf("corrupt=%s", a.Corrupt))
+	}
+	if a.Partition != nil {
+		parts = append(parts, fmt.Sprintf("partition=%s", a.Partition))
+	}
+	if a.StateChangeError != nil {
+		parts = append(parts, fmt.Sprintf("stateChangeError=%d", a.StateChangeError.Code))
+	}
+	if a.Respond != nil {
+		parts = append(parts, "respond")
+	}
+	return strings.Join(parts, ", ")
 }
 
-// testInstruction holds the ordered list of actions.
+// testInstruction holds the ordered list of actions, and any rules to arm
+// against later commands.
 type testInstruction struct {
 	Actions []action `bson:"actions"`
+	Arm     []rule   `bson:"arm"`
 }
 
-// parseProxy looks for a `proxyTest` field in the command document, unmarshals
-// its actions, removes the field, and returns the cleaned document + instructions.
-func parseProxy(cmdDoc bson.Raw) (cleanDoc bson.Raw, instr *testInstruction, err error) {
-	// Quick unmarshal of only the proxyTest.actions array.
-	var wrapper struct {
-		ProxyTest struct {
-			Actions []bson.Raw `bson:"actions"`
-		} `bson:"proxyTest"`
-	}
-	if err := bson.Unmarshal(cmdDoc, &wrapper); err != nil {
-		return nil, nil, fmt.Errorf("failed to unmarshal command document: %w", err)
+// rule applies its actions to the replies of later commands that match.
+type rule struct {
+	Match   ruleMatch `bson:"match"`
+	Actions []action  `bson:"actions"`
+	Times   *int      `bson:"times,omitempty"` // matches to apply to; default 1, negative for every match
+}
+
+// ruleMatch selects the commands a rule applies to. Every set field must
+// match.
+type ruleMatch struct {
+	Command  *string  `bson:"command,omitempty"`  // command name, e.g. "commitTransaction"; "hello" also matches isMaster
+	Commands []string `bson:"commands,omitempty"` // any of these command names
+
+	SameSession     *bool `bson:"sameSession,omitempty"`     // only the session that armed the rule
+	InTransaction   *bool `bson:"inTransaction,omitempty"`   // whether the command is part of a transaction
+	TxnStatement    *int  `bson:"txnStatement,omitempty"`    // Nth statement of a transaction, from 1
+	NextTransaction *bool `bson:"nextTransaction,omitempty"` // only transactions after the arming command's
+
+	CursorID        *int64 `bson:"cursorId,omitempty"`        // getMores on this cursor
+	SameCursor      *bool  `bson:"sameCursor,omitempty"`      // getMores on the cursor the arming command opened
+	GetMore         *int   `bson:"getMore,omitempty"`         // Nth getMore on its cursor, from 1
+	CrossesDocCount *int   `bson:"crossesDocCount,omitempty"` // the batch that brings the cursor to N documents
+	ChangeStream    *bool  `bson:"changeStream,omitempty"`    // whether the cursor is a change stream
+
+	Auth                    *bool `bson:"auth,omitempty"`                    // saslStart, saslContinue and authenticate
+	SpeculativeAuthenticate *bool `bson:"speculativeAuthenticate,omitempty"` // hello commands that start authenticating
+
+	AppName    *string `bson:"appName,omitempty"`    // client.application.name from the connection's handshake
+	DriverName *string `bson:"driverName,omitempty"` // client.driver.name from the connection's handshake
+	Connection *string `bson:"connection,omitempty"` // "monitoring", "rtt" or "pool"
+
+	Comment *string `bson:"comment,omitempty"` // commands whose comment is this string
+}
+
+// String describes the instruction's actions in order.
+func (ti *testInstruction) String() string {
+	parts := make([]string, len(ti.Actions))
+	for i, a := range ti.Actions {
+		parts[i] = a.String()
 	}
+	return strings.Join(parts, "; ")
+}
 
-	if wrapper.ProxyTest.Actions == nil {
-		return cmdDoc, nil, nil // no proxyTest actions, nothing to do
+// defaultTestKey is the command field test instructions are read from,
+// unless configured otherwise.
+const defaultTestKey = "proxyTest"
+
+// dslConfig says where a proxy looks for test instructions. The zero value
+// reads them from proxyTest.
+type dslConfig struct {
+	keys     []string // command fields to read instructions from, in order
+	keep     bool     // forward the fields to the server instead of removing them
+	comments bool     // also read them from the same fields of the command's comment
+}
+
+// testKeys returns the fields to read instructions from.
+func (c dslConfig) testKeys() []string {
+	if len(c.keys) == 0 {
+		return []string{defaultTestKey}
 	}
+	return c.keys
+}
 
-	// 2) Decode each raw action
+// parseProxy is dslConfig.parse with the default configuration.
+func parseProxy(cmdDoc bson.Raw) (cleanDoc bson.Raw, instr *testInstruction, err error) {
+	return dslConfig{}.parse(cmdDoc)
+}
+
+// parse looks for the configured fields in the command document, unmarshals
+// their actions, removes the fields, and returns the cleaned document +
+// instructions. The instructions of several fields are run in the order the
+// fields are configured in. Unknown fields, values of the wrong type and
+// invalid settings are errors naming the field, e.g.
+// "proxyTest.actions[0].delay: unknown field".
+func (c dslConfig) parse(cmdDoc bson.Raw) (cleanDoc bson.Raw, instr *testInstruction, err error) {
 	instr = &testInstruction{}
-	for i, raw := range wrapper.ProxyTest.Actions {
-		var a action
-		if err := bson.Unmarshal(raw, &a); err != nil {
-			return nil, nil, fmt.Errorf("failed to unmarshal action %d: %w", i, err)
+	cleanDoc = cmdDoc
+
+	for _, key := range c.testKeys() {
+		val, err := cmdDoc.LookupErr(key)
+		if err != nil {
+			continue
+		}
+
+		if err := instr.merge(val, key); err != nil {
+			return nil, nil, err
+		}
+
+		// Remove the key so the real server never sees it
+		if !c.keep {
+			cleanDoc = removeKey(cleanDoc, key)
+		}
+	}
+
+	if c.comments {
+		cleanDoc, err = c.parseComment(cleanDoc, instr)
+		if err != nil {
+			return nil, nil, err
 		}
-		instr.Actions = append(instr.Actions, a)
 	}
 
-	// 3) Remove the proxyTest key so the real server never sees it
-	cleanDoc = removeKey(cmdDoc, "proxyTest")
+	if instr.Actions == nil && instr.Arm == nil {
+		return cleanDoc, nil, nil
+	}
 	return cleanDoc, instr, nil
 }
 
+// parseComment adds the instructions held by the command's comment to instr
+// and returns the command with them removed from the comment, or without the
+// comment if nothing else is left in it. The comment may be a document, or
+// for drivers that only send strings, a document in Extended JSON.
+func (c dslConfig) parseComment(cmdDoc bson.Raw, instr *testInstruction) (bson.Raw, error) {
+	val, err := cmdDoc.LookupErr("comment")
+	if err != nil {
+		return cmdDoc, nil
+	}
+
+	comment, isDoc := val.DocumentOK()
+	if !isDoc {
+		str, ok := val.StringValueOK()
+		if !ok || bson.UnmarshalExtJSON([]byte(str), false, &comment) != nil {
+			return cmdDoc, nil // an ordinary comment
+		}
+	}
+
+	found := false
+	for _, key := range c.testKeys() {
+		val, err := comment.LookupErr(key)
+		if err != nil {
+			continue
+		}
+
+		if err := instr.merge(val, "comment."+key); err != nil {
+			return nil, err
+		}
+		found = true
+
+		if !c.keep {
+			comment = removeKey(comment, key)
+		}
+	}
+
+	if !found || c.keep {
+		return cmdDoc, nil
+	}
+
+	if len(comment) <= 5 {
+		return removeKey(cmdDoc, "comment"), nil
+	}
+
+	if isDoc {
+		return replaceKey(cmdDoc, bsoncore.AppendDocumentElement(nil, "comment", comment)), nil
+	}
+
+	str, err := bson.MarshalExtJSON(comment, false, false)
+	if err != nil {
+		return nil, fmt.Errorf("comment: %w", err)
+	}
+	return replaceKey(cmdDoc, bsoncore.AppendStringElement(nil, "comment", string(str))), nil
+}
+
+// merge decodes the instruction in val, read from path, and appends its
+// actions and rules to ti's.
+func (ti *testInstruction) merge(val bson.RawValue, path string) error {
+	raw, ok := val.DocumentOK()
+	if !ok {
+		return fmt.Errorf("%s: must be a document, not %s", path, val.Type)
+	}
+
+	var parsed testInstruction
+	if err := decodeStrict(raw, &parsed, path); err != nil {
+		return err
+	}
+	if err := parsed.validate(path); err != nil {
+		return err
+	}
+
+	ti.Actions = append(ti.Actions, parsed.Actions...)
+	ti.Arm = append(ti.Arm, parsed.Arm...)
+	return nil
+}
+
+// invalidProxyTest is the reply to a command whose test instruction was
+// rejected. The error's path names the key the instruction was read from.
+func invalidProxyTest(err error) bson.Raw {
+	msg := strings.ReplaceAll(err.Error(), "\n", "; ")
+	return (&errorReply{Code: 2, CodeName: "BadValue", Errmsg: "invalid test instruction: " + msg}).document(nil)
+}
+
+// decodeStrict unmarshals doc into v, a pointer to one of the DSL types,
+// reporting fields v has no room for instead of ignoring them. path names
+// doc in errors.
+func decodeStrict(doc bson.Raw, v any, path string) error {
+	var generic bson.D
+	if err := bson.Unmarshal(doc, &generic); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	if err := checkFields(generic, reflect.TypeOf(v), path); err != nil {
+		return err
+	}
+
+	if err := bson.Unmarshal(doc, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// validate checks the settings the decoder cannot, such as partition modes.
+func (ti *testInstruction) validate(path string) error {
+	var errs []error
+	for i, a := range ti.Actions {
+		errs = append(errs, a.validate(fmt.Sprintf("%s.actions[%d]", path, i)))
+	}
+	for i, r := range ti.Arm {
+		errs = append(errs, r.validate(fmt.Sprintf("%s.arm[%d]", path, i)))
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks the rule's match and actions. A rule needs at least one
+// action, since one without any would only use up its times.
+func (r rule) validate(path string) error {
+	var errs []error
+	if len(r.Actions) == 0 {
+		errs = append(errs, fmt.Errorf("%s.actions: at least one is required", path))
+	}
+	if c := r.Match.Connection; c != nil && *c != kindMonitoring.String() && *c != kindRTT.String() && *c != kindPool.String() {
+		errs = append(errs, fmt.Errorf("%s.match.connection: must be monitoring, rtt or pool, not %q", path, *c))
+	}
+	for i, a := range r.Actions {
+		errs = append(errs, a.validate(fmt.Sprintf("%s.actions[%d]", path, i)))
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks the action's settings.
+func (a action) validate(path string) error {
+	var errs []error
+	nonNegative := func(v *int, name string) {
+		if v != nil && *v < 0 {
+			errs = append(errs, fmt.Errorf("%s.%s: must not be negative", path, name))
+		}
+	}
+
+	nonNegative(a.DelayMs, "delayMs")
+	nonNegative(a.SendBytes, "sendBytes")
+	nonNegative(a.SplitBatch, "splitBatch")
+
+	for i, m := range a.MutateReply {
+		if err := m.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s.mutateReply[%d]: %w", path, i, err))
+		}
+	}
+
+	if a.Partition != nil {
+		if err := a.Partition.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s.partition: %w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// replaceKey rebuilds a BSON document with the top-level element of the same
+// key as elem replaced by it.
+func replaceKey(doc bson.Raw, elem bsoncore.Element) bson.Raw {
+	elems, _ := bsoncore.Document(doc).Elements()
+	rawElems := make([][]byte, 0, len(elems))
+	for _, e := range elems {
+		if e.Key() == elem.Key() {
+			rawElems = append(rawElems, elem)
+			continue
+		}
+		rawElems = append(rawElems, []byte(e))
+	}
+	return bson.Raw(bsoncore.BuildDocument(nil, rawElems...))
+}
+
 // removeKey rebuilds a BSON document without the given top-level key.
 func removeKey(doc bson.Raw, key string) bson.Raw {
 	// Convert to bsoncore.Document to iterate elements
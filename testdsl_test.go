@@ -1,6 +1,7 @@
 package mongoproxy
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 
@@ -80,3 +81,269 @@ func TestParseProxy_WithProxyTest_Zero(t *testing.T) {
 		require.NotEqual(t, "proxyTest", e.Key(), "cleanDoc must not contain proxyTest")
 	}
 }
+
+func TestParseProxy_WithArm(t *testing.T) {
+	cmdD := bson.D{
+		{Key: "insert", Value: "coll"},
+		{Key: "proxyTest", Value: bson.D{{Key: "arm", Value: bson.A{
+			bson.D{
+				{Key: "match", Value: bson.D{{Key: "command", Value: "commitTransaction"}}},
+				{Key: "actions", Value: bson.A{bson.D{{Key: "dropReply", Value: true}}}},
+				{Key: "times", Value: 2},
+			},
+		}}}},
+	}
+	rawBytes, err := bson.Marshal(cmdD)
+	require.NoError(t, err)
+
+	_, instr, err := parseProxy(bson.Raw(rawBytes))
+	require.NoError(t, err)
+	require.NotNil(t, instr, "expected non-nil testInstruction for arm-only proxyTest")
+
+	require.Empty(t, instr.Actions)
+	require.Len(t, instr.Arm, 1)
+	require.Equal(t, "commitTransaction", *instr.Arm[0].Match.Command)
+	require.Equal(t, 2, *instr.Arm[0].Times)
+	require.True(t, *instr.Arm[0].Actions[0].DropReply)
+}
+
+func TestParseProxy_Invalid(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		proxyTest any
+		want      string
+	}{
+		{
+			name:      "unknown action field",
+			proxyTest: bson.D{{Key: "actions", Value: bson.A{bson.D{{Key: "delay", Value: 200}}}}},
+			want:      "proxyTest.actions[0].delay: unknown field",
+		},
+		{
+			name:      "unknown top-level field",
+			proxyTest: bson.D{{Key: "action", Value: bson.A{}}},
+			want:      "proxyTest.action: unknown field",
+		},
+		{
+			name:      "wrong type",
+			proxyTest: bson.D{{Key: "actions", Value: bson.A{bson.D{{Key: "delayMs", Value: "200"}}}}},
+			want:      "delayMs",
+		},
+		{
+			name: "unknown match field",
+			proxyTest: bson.D{{Key: "arm", Value: bson.A{bson.D{
+				{Key: "match", Value: bson.D{{Key: "cmd", Value: "find"}}},
+			}}}},
+			want: "proxyTest.arm[0].match.cmd: unknown field",
+		},
+		{
+			name: "invalid connection kind",
+			proxyTest: bson.D{{Key: "arm", Value: bson.A{bson.D{
+				{Key: "match", Value: bson.D{{Key: "connection", Value: "monitor"}}},
+			}}}},
+			want: "proxyTest.arm[0].match.connection",
+		},
+		{
+			name: "rule without actions",
+			proxyTest: bson.D{{Key: "arm", Value: bson.A{bson.D{
+				{Key: "match", Value: bson.D{{Key: "command", Value: "find"}}},
+			}}}},
+			want: "proxyTest.arm[0].actions: at least one is required",
+		},
+		{
+			name:      "invalid partition",
+			proxyTest: bson.D{{Key: "actions", Value: bson.A{bson.D{{Key: "partition", Value: bson.D{{Key: "mode", Value: "cut"}}}}}}},
+			want:      "proxyTest.actions[0].partition: unknown partition mode",
+		},
+		{
+			name:      "negative sendBytes",
+			proxyTest: bson.D{{Key: "actions", Value: bson.A{bson.D{{Key: "sendBytes", Value: -1}}}}},
+			want:      "proxyTest.actions[0].sendBytes: must not be negative",
+		},
+		{
+			name:      "negative delayMs",
+			proxyTest: bson.D{{Key: "actions", Value: bson.A{bson.D{{Key: "delayMs", Value: -5}}}}},
+			want:      "proxyTest.actions[0].delayMs: must not be negative",
+		},
+		{
+			name:      "negative splitBatch",
+			proxyTest: bson.D{{Key: "actions", Value: bson.A{bson.D{{Key: "splitBatch", Value: -2}}}}},
+			want:      "proxyTest.actions[0].splitBatch: must not be negative",
+		},
+		{
+			name: "unknown mutation op",
+			proxyTest: bson.D{{Key: "actions", Value: bson.A{bson.D{{Key: "mutateReply", Value: bson.A{
+				bson.D{{Key: "op", Value: "sett"}, {Key: "path", Value: "n"}},
+			}}}}}},
+			want: `proxyTest.actions[0].mutateReply[0]: unknown op "sett"`,
+		},
+		{
+			name: "mutation without path",
+			proxyTest: bson.D{{Key: "actions", Value: bson.A{bson.D{{Key: "mutateReply", Value: bson.A{
+				bson.D{{Key: "op", Value: "unset"}},
+			}}}}}},
+			want: "proxyTest.actions[0].mutateReply[0]: path is required",
+		},
+		{
+			name: "rename without to",
+			proxyTest: bson.D{{Key: "arm", Value: bson.A{bson.D{
+				{Key: "match", Value: bson.D{{Key: "command", Value: "find"}}},
+				{Key: "actions", Value: bson.A{bson.D{{Key: "mutateReply", Value: bson.A{
+					bson.D{{Key: "op", Value: "rename"}, {Key: "path", Value: "n"}},
+				}}}}},
+			}}}},
+			want: "proxyTest.arm[0].actions[0].mutateReply[0]: rename needs to",
+		},
+		{
+			name:      "not a document",
+			proxyTest: 1,
+			want:      "proxyTest: must be a document",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd, err := bson.Marshal(bson.D{{Key: "ping", Value: 1}, {Key: "proxyTest", Value: tc.proxyTest}})
+			require.NoError(t, err)
+
+			_, _, err = parseProxy(cmd)
+			require.ErrorContains(t, err, tc.want)
+		})
+	}
+}
+
+func TestParseProxy_Empty(t *testing.T) {
+	cmd, err := bson.Marshal(bson.D{{Key: "ping", Value: 1}, {Key: "proxyTest", Value: bson.D{}}})
+	require.NoError(t, err)
+
+	cleanRaw, instr, err := parseProxy(cmd)
+	require.NoError(t, err)
+	require.Nil(t, instr)
+
+	_, err = cleanRaw.LookupErr("proxyTest")
+	require.Error(t, err, "an empty proxyTest should not reach the server either")
+}
+
+func TestInvalidProxyTest(t *testing.T) {
+	reply := invalidProxyTest(errors.Join(errors.New("a: unknown field"), errors.New("b: unknown field")))
+
+	require.Equal(t, 0.0, reply.Lookup("ok").Double())
+	require.Equal(t, int32(2), reply.Lookup("code").Int32())
+	require.Equal(t, "invalid test instruction: a: unknown field; b: unknown field", reply.Lookup("errmsg").StringValue())
+}
+
+func TestDSLConfigKeys(t *testing.T) {
+	cfg := dslConfig{keys: []string{"proxyTestA", "proxyTestC"}}
+
+	cmd, err := bson.Marshal(bson.D{
+		{Key: "ping", Value: 1},
+		{Key: "proxyTestC", Value: bson.D{{Key: "actions", Value: bson.A{bson.D{{Key: "delayMs", Value: 2}}}}}},
+		{Key: "proxyTestA", Value: bson.D{{Key: "actions", Value: bson.A{bson.D{{Key: "delayMs", Value: 1}}}}}},
+		{Key: "proxyTestB", Value: bson.D{{Key: "actions", Value: bson.A{bson.D{{Key: "delayMs", Value: 3}}}}}},
+	})
+	require.NoError(t, err)
+
+	cleanRaw, instr, err := cfg.parse(cmd)
+	require.NoError(t, err)
+	require.Len(t, instr.Actions, 2)
+	require.Equal(t, 1, *instr.Actions[0].DelayMs, "keys are read in the configured order")
+	require.Equal(t, 2, *instr.Actions[1].DelayMs)
+
+	_, err = cleanRaw.LookupErr("proxyTestA")
+	require.Error(t, err)
+	_, err = cleanRaw.LookupErr("proxyTestB")
+	require.NoError(t, err, "another proxy's key should be passed on")
+}
+
+func TestDSLConfigKeep(t *testing.T) {
+	cmd, err := bson.Marshal(bson.D{
+		{Key: "ping", Value: 1},
+		{Key: "proxyTest", Value: bson.D{{Key: "actions", Value: bson.A{bson.D{{Key: "delayMs", Value: 1}}}}}},
+	})
+	require.NoError(t, err)
+
+	cleanRaw, instr, err := dslConfig{keep: true}.parse(cmd)
+	require.NoError(t, err)
+	require.Len(t, instr.Actions, 1)
+	require.Equal(t, bson.Raw(cmd), cleanRaw)
+}
+
+func TestDSLConfigComment(t *testing.T) {
+	proxyTest := bson.D{{Key: "actions", Value: bson.A{bson.D{{Key: "delayMs", Value: 1}}}}}
+	cfg := dslConfig{comments: true}
+
+	for _, tc := range []struct {
+		name    string
+		comment any
+		want    any // the comment left in the command; nil for none
+	}{
+		{
+			name:    "document",
+			comment: bson.D{{Key: "proxyTest", Value: proxyTest}},
+		},
+		{
+			name:    "document with other fields",
+			comment: bson.D{{Key: "trace", Value: "abc"}, {Key: "proxyTest", Value: proxyTest}},
+			want:    bson.D{{Key: "trace", Value: "abc"}},
+		},
+		{
+			name:    "Extended JSON",
+			comment: `{"proxyTest": {"actions": [{"delayMs": 1}]}}`,
+		},
+		{
+			name:    "Extended JSON with other fields",
+			comment: `{"trace": "abc", "proxyTest": {"actions": [{"delayMs": 1}]}}`,
+			want:    `{"trace":"abc"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd, err := bson.Marshal(bson.D{{Key: "find", Value: "coll"}, {Key: "comment", Value: tc.comment}})
+			require.NoError(t, err)
+
+			cleanRaw, instr, err := cfg.parse(cmd)
+			require.NoError(t, err)
+			require.NotNil(t, instr)
+			require.Equal(t, 1, *instr.Actions[0].DelayMs)
+
+			comment, err := cleanRaw.LookupErr("comment")
+			if tc.want == nil {
+				require.Error(t, err, "a comment holding only instructions should be removed")
+				return
+			}
+			require.NoError(t, err)
+
+			want, err := bson.Marshal(bson.D{{Key: "comment", Value: tc.want}})
+			require.NoError(t, err)
+			require.Equal(t, bson.Raw(want).Lookup("comment"), comment)
+		})
+	}
+}
+
+func TestDSLConfigCommentIgnored(t *testing.T) {
+	withInstructions, err := bson.Marshal(bson.D{
+		{Key: "find", Value: "coll"},
+		{Key: "comment", Value: bson.D{{Key: "proxyTest", Value: bson.D{{Key: "actions", Value: bson.A{}}}}}},
+	})
+	require.NoError(t, err)
+
+	cleanRaw, instr, err := dslConfig{}.parse(withInstructions)
+	require.NoError(t, err)
+	require.Nil(t, instr, "comments are only read when enabled")
+	require.Equal(t, bson.Raw(withInstructions), cleanRaw)
+
+	ordinary, err := bson.Marshal(bson.D{{Key: "find", Value: "coll"}, {Key: "comment", Value: "nightly report"}})
+	require.NoError(t, err)
+
+	cleanRaw, instr, err = dslConfig{comments: true}.parse(ordinary)
+	require.NoError(t, err)
+	require.Nil(t, instr)
+	require.Equal(t, bson.Raw(ordinary), cleanRaw)
+}
+
+func TestDSLConfigCommentInvalid(t *testing.T) {
+	cmd, err := bson.Marshal(bson.D{
+		{Key: "find", Value: "coll"},
+		{Key: "comment", Value: `{"proxyTest": {"actions": [{"delay": 1}]}}`},
+	})
+	require.NoError(t, err)
+
+	_, _, err = dslConfig{comments: true}.parse(cmd)
+	require.ErrorContains(t, err, "comment.proxyTest.actions[0].delay: unknown field")
+}
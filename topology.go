@@ -0,0 +1,145 @@
+package mongoproxy
+
+import (
+	"fmt"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// topologyVersion is the version of a server's view of the topology, sent
+// in hello replies and state-change errors.
+type topologyVersion struct {
+	ProcessID bson.ObjectID `bson:"processId"`
+	Counter   int64         `bson:"counter"`
+}
+
+// topologyShift lets the proxy fake state-change errors newer than anything
+// the server has sent. Every stateChangeError raises an offset that is added
+// to the counter of the topologyVersions the server sends, and taken off
+// those clients send back, so that replies sent after a fake error are not
+// stale next to it and the server never sees a counter it did not hand out.
+// The zero value is ready to use.
+type topologyShift struct {
+	mu     sync.Mutex
+	latest topologyVersion // latest sent by the server, or made up by bump
+	offset int64           // fake errors since latest.ProcessID started
+}
+
+// bump returns a topologyVersion newer than any the clients have seen.
+func (ts *topologyShift) bump() topologyVersion {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.latest.ProcessID.IsZero() {
+		// No hello reply yet. A process ID of its own makes the version
+		// newer than any the server sends, and the server's newer still.
+		ts.latest.ProcessID = bson.NewObjectID()
+	}
+
+	ts.offset++
+	return topologyVersion{ProcessID: ts.latest.ProcessID, Counter: ts.latest.Counter + ts.offset}
+}
+
+// raise records tv, sent by the server, and returns it as clients should
+// see it.
+func (ts *topologyShift) raise(tv topologyVersion) topologyVersion {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if tv.ProcessID != ts.latest.ProcessID {
+		// The server restarted, or bump made a process ID up: nothing
+		// clients have seen for this process is fake.
+		ts.latest, ts.offset = tv, 0
+		return tv
+	}
+
+	ts.latest.Counter = max(ts.latest.Counter, tv.Counter)
+	tv.Counter += ts.offset
+	return tv
+}
+
+// lower returns tv, sent by a client, as the server handed it out. A client
+// still on a version from before the latest fake error gets a counter lower
+// than the server's, which makes a streaming hello return at once.
+func (ts *topologyShift) lower(tv topologyVersion) topologyVersion {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if tv.ProcessID != ts.latest.ProcessID {
+		return tv
+	}
+
+	tv.Counter = max(tv.Counter-ts.offset, 0)
+	return tv
+}
+
+// raiseReply applies raise to the topologyVersion of the reply in buf, if it
+// has one.
+func (ts *topologyShift) raiseReply(buf []byte) []byte {
+	reply, ok := replyDocument(buf)
+	if !ok {
+		return buf
+	}
+
+	tv, ok := lookupTopologyVersion(reply)
+	if !ok {
+		return buf
+	}
+
+	raised := ts.raise(tv)
+	if raised == tv {
+		return buf
+	}
+
+	return editReply(buf, func(reply bson.Raw) (bson.Raw, error) {
+		return withTopologyVersion(reply, raised)
+	})
+}
+
+// lowerRequest applies lower to the topologyVersion of a streaming hello.
+func (ts *topologyShift) lowerRequest(cmd bson.Raw) bson.Raw {
+	tv, ok := lookupTopologyVersion(cmd)
+	if !ok {
+		return cmd
+	}
+
+	lowered := ts.lower(tv)
+	if lowered == tv {
+		return cmd
+	}
+
+	edited, err := withTopologyVersion(cmd, lowered)
+	if err != nil {
+		return cmd
+	}
+	return edited
+}
+
+// lookupTopologyVersion returns the topologyVersion field of doc.
+func lookupTopologyVersion(doc bson.Raw) (topologyVersion, bool) {
+	raw, ok := doc.Lookup("topologyVersion").DocumentOK()
+	if !ok {
+		return topologyVersion{}, false
+	}
+
+	var tv topologyVersion
+	if err := bson.Unmarshal(raw, &tv); err != nil {
+		return topologyVersion{}, false
+	}
+	return tv, true
+}
+
+// withTopologyVersion returns doc with its topologyVersion field set to tv.
+func withTopologyVersion(doc bson.Raw, tv topologyVersion) (bson.Raw, error) {
+	var d bson.D
+	if err := bson.Unmarshal(doc, &d); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal document: %w", err)
+	}
+
+	d = setField(d, "topologyVersion", bson.D{
+		{Key: "processId", Value: tv.ProcessID},
+		{Key: "counter", Value: tv.Counter},
+	})
+	return bson.Marshal(d)
+}
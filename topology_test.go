@@ -0,0 +1,80 @@
+package mongoproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func helloReplyWithVersion(tv topologyVersion) bson.D {
+	return bson.D{
+		{Key: "isWritablePrimary", Value: true},
+		{Key: "topologyVersion", Value: bson.D{
+			{Key: "processId", Value: tv.ProcessID},
+			{Key: "counter", Value: tv.Counter},
+		}},
+		{Key: "ok", Value: 1.0},
+	}
+}
+
+func TestTopologyShift(t *testing.T) {
+	var ts topologyShift
+	server := topologyVersion{ProcessID: bson.NewObjectID(), Counter: 3}
+
+	require.Equal(t, server, ts.raise(server), "nothing to shift before a fake error")
+
+	fake := ts.bump()
+	require.Equal(t, topologyVersion{ProcessID: server.ProcessID, Counter: 4}, fake)
+
+	raised := ts.raise(server)
+	require.Equal(t, int64(4), raised.Counter, "replies after the error should not be stale")
+	require.Equal(t, server, ts.lower(raised), "the server should get its own counter back")
+
+	require.Equal(t, int64(5), ts.bump().Counter)
+	require.Equal(t, int64(2), ts.lower(raised).Counter, "clients behind the latest error should get an immediate reply")
+
+	restarted := topologyVersion{ProcessID: bson.NewObjectID()}
+	require.Equal(t, restarted, ts.raise(restarted))
+	require.Equal(t, raised, ts.lower(raised), "versions of other processes are left alone")
+}
+
+func TestTopologyShiftBeforeHello(t *testing.T) {
+	var ts topologyShift
+
+	fake := ts.bump()
+	require.False(t, fake.ProcessID.IsZero())
+	require.Equal(t, int64(1), fake.Counter)
+
+	server := topologyVersion{ProcessID: bson.NewObjectID()}
+	require.Equal(t, server, ts.raise(server), "a different process ID is already newer")
+}
+
+func TestTopologyShiftReply(t *testing.T) {
+	var ts topologyShift
+	server := topologyVersion{ProcessID: bson.NewObjectID(), Counter: 7}
+
+	msg := buildOpMsg(t, 1, 0, helloReplyWithVersion(server))
+	require.Equal(t, msg, ts.raiseReply(msg))
+
+	ts.bump()
+	reply, ok := replyDocument(ts.raiseReply(msg))
+	require.True(t, ok)
+
+	tv, ok := lookupTopologyVersion(reply)
+	require.True(t, ok)
+	require.Equal(t, int64(8), tv.Counter)
+	require.True(t, reply.Lookup("isWritablePrimary").Boolean())
+
+	hello := marshalDoc(t, bson.D{
+		{Key: "hello", Value: 1},
+		{Key: "topologyVersion", Value: bson.D{{Key: "processId", Value: server.ProcessID}, {Key: "counter", Value: int64(8)}}},
+		{Key: "maxAwaitTimeMS", Value: int64(10000)},
+	})
+	tv, ok = lookupTopologyVersion(ts.lowerRequest(hello))
+	require.True(t, ok)
+	require.Equal(t, server, tv)
+
+	ping := marshalDoc(t, bson.D{{Key: "ping", Value: 1}})
+	require.Equal(t, ping, ts.lowerRequest(ping))
+}
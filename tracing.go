@@ -0,0 +1,101 @@
+package mongoproxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/prestonvasquez/mongoproxy"
+
+// newTracerProvider builds a tracer provider exporting spans over OTLP/HTTP
+// to endpoint, e.g. "localhost:4318".
+func newTracerProvider(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpoint(endpoint),
+		otlptracehttp.WithInsecure(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter for %s: %w", endpoint, err)
+	}
+
+	res := resource.NewSchemaless(semconv.ServiceName("mongoproxy"))
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// noopTracer is used when tracing is disabled.
+var noopTracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// startCommandSpan starts a span for a command read from the client. If the
+// command carries W3C trace context in its comment, the span links to it.
+func startCommandSpan(tracer trace.Tracer, cmdDoc bson.Raw, name string, requestID int32, size int) trace.Span {
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemMongoDB,
+		semconv.DBOperationName(name),
+		attribute.Int64("mongoproxy.request_id", int64(requestID)),
+		attribute.Int("mongoproxy.request_bytes", size),
+	}
+
+	if db, ok := cmdDoc.Lookup("$db").StringValueOK(); ok {
+		attrs = append(attrs, semconv.DBNamespace(db))
+	}
+
+	// Most commands name their collection as the value of the command key.
+	if elem, err := cmdDoc.IndexErr(0); err == nil {
+		if coll, ok := elem.Value().StringValueOK(); ok {
+			attrs = append(attrs, semconv.DBCollectionName(coll))
+		}
+	}
+
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	}
+
+	if sc := commentSpanContext(cmdDoc); sc.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+	}
+
+	_, span := tracer.Start(context.Background(), name, opts...)
+	return span
+}
+
+// commentSpanContext extracts a W3C traceparent from the command's comment.
+// The comment may be the traceparent string itself or a document with
+// "traceparent" and optionally "tracestate" fields.
+func commentSpanContext(cmdDoc bson.Raw) trace.SpanContext {
+	comment, err := cmdDoc.LookupErr("comment")
+	if err != nil {
+		return trace.SpanContext{}
+	}
+
+	carrier := propagation.MapCarrier{}
+
+	if s, ok := comment.StringValueOK(); ok {
+		carrier.Set("traceparent", strings.TrimSpace(s))
+	} else if doc, ok := comment.DocumentOK(); ok {
+		if tp, ok := doc.Lookup("traceparent").StringValueOK(); ok {
+			carrier.Set("traceparent", tp)
+		}
+		if ts, ok := doc.Lookup("tracestate").StringValueOK(); ok {
+			carrier.Set("tracestate", ts)
+		}
+	}
+
+	ctx := propagation.TraceContext{}.Extract(context.Background(), carrier)
+	return trace.SpanContextFromContext(ctx)
+}
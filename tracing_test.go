@@ -0,0 +1,43 @@
+package mongoproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestCommentSpanContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		comment interface{}
+		valid   bool
+	}{
+		{name: "string", comment: testTraceparent, valid: true},
+		{name: "document", comment: bson.D{{Key: "traceparent", Value: testTraceparent}}, valid: true},
+		{name: "unrelated string", comment: "hello", valid: false},
+		{name: "missing", comment: nil, valid: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := bson.D{{Key: "find", Value: "coll"}}
+			if test.comment != nil {
+				cmd = append(cmd, bson.E{Key: "comment", Value: test.comment})
+			}
+
+			raw, err := bson.Marshal(cmd)
+			require.NoError(t, err)
+
+			sc := commentSpanContext(raw)
+			require.Equal(t, test.valid, sc.IsValid())
+
+			if test.valid {
+				require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID().String())
+				require.Equal(t, "00f067aa0ba902b7", sc.SpanID().String())
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package mongoproxy
+
+import (
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// defaultSessionTimeout is the server's default logicalSessionTimeoutMinutes.
+const defaultSessionTimeout = 30 * time.Minute
+
+// sessionState is what the proxy knows about a logical session.
+type sessionState struct {
+	txnNumber  int64     // latest transaction number seen
+	statements int       // statements seen in that transaction
+	lastUsed   time.Time // when the session last ran a command
+}
+
+// sessionTracker follows the transactions of every logical session seen by a
+// proxy. Sessions outlive connections, so it is shared by all of them.
+// Sessions idle for longer than the server would keep them are forgotten, as
+// drivers do not always end them. The zero value is ready to use.
+type sessionTracker struct {
+	mu       sync.Mutex
+	sessions map[string]*sessionState
+	timeout  time.Duration // longest logicalSessionTimeoutMinutes seen
+	swept    time.Time     // when idle sessions were last forgotten
+}
+
+// observeTimeout raises the idle timeout to the logicalSessionTimeoutMinutes
+// of a hello reply, so sessions are kept at least as long as the server
+// keeps them.
+func (st *sessionTracker) observeTimeout(reply bson.Raw) {
+	minutes, ok := reply.Lookup("logicalSessionTimeoutMinutes").AsInt64OK()
+	if !ok {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.timeout = max(st.timeout, time.Duration(minutes)*time.Minute)
+}
+
+// sweep forgets sessions idle for longer than the timeout, at most once a
+// minute. The caller must hold st.mu.
+func (st *sessionTracker) sweep(now time.Time) {
+	if now.Sub(st.swept) < time.Minute {
+		return
+	}
+	st.swept = now
+
+	timeout := max(st.timeout, defaultSessionTimeout)
+	for lsid, s := range st.sessions {
+		if now.Sub(s.lastUsed) > timeout {
+			delete(st.sessions, lsid)
+		}
+	}
+}
+
+// observe fills in the session and transaction fields of info from its
+// command document, counting the command as a statement of its transaction.
+// commitTransaction and abortTransaction are not counted as statements.
+func (st *sessionTracker) observe(info *commandInfo) {
+	_, id, ok := info.doc.Lookup("lsid", "id").BinaryOK()
+	if !ok {
+		return
+	}
+	info.lsid = string(id)
+
+	txnNumber, ok := info.doc.Lookup("txnNumber").AsInt64OK()
+	if !ok {
+		return
+	}
+	info.txnNumber = txnNumber
+
+	// Retryable writes carry a txnNumber too; only autocommit:false marks a
+	// multi-statement transaction.
+	if autocommit, ok := info.doc.Lookup("autocommit").BooleanOK(); !ok || autocommit {
+		return
+	}
+	info.inTxn = true
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.sessions == nil {
+		st.sessions = make(map[string]*sessionState)
+	}
+
+	now := time.Now()
+	st.sweep(now)
+
+	s, ok := st.sessions[info.lsid]
+	if !ok {
+		s = &sessionState{}
+		st.sessions[info.lsid] = s
+	}
+	s.lastUsed = now
+
+	startTxn, _ := info.doc.Lookup("startTransaction").BooleanOK()
+	if startTxn || txnNumber != s.txnNumber {
+		s.txnNumber = txnNumber
+		s.statements = 0
+	}
+
+	if info.name != "commitTransaction" && info.name != "abortTransaction" {
+		s.statements++
+	}
+	info.txnStatement = s.statements
+}
+
+// endSessions forgets the sessions ended by an endSessions command.
+func (st *sessionTracker) endSessions(doc bson.Raw) {
+	ids, ok := doc.Lookup("endSessions").ArrayOK()
+	if !ok {
+		return
+	}
+
+	values, err := ids.Values()
+	if err != nil {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, v := range values {
+		lsid, ok := v.DocumentOK()
+		if !ok {
+			continue
+		}
+		if _, data, ok := lsid.Lookup("id").BinaryOK(); ok {
+			delete(st.sessions, string(data))
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package mongoproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// txnCommand builds a command in a transaction on the session with the given
+// ID byte.
+func txnCommand(t *testing.T, name string, session byte, txnNumber int64, start bool) commandInfo {
+	t.Helper()
+
+	cmd := bson.D{
+		{Key: name, Value: 1},
+		{Key: "lsid", Value: bson.D{{Key: "id", Value: bson.Binary{Subtype: 4, Data: []byte{session}}}}},
+		{Key: "txnNumber", Value: txnNumber},
+		{Key: "autocommit", Value: false},
+	}
+	if start {
+		cmd = append(cmd, bson.E{Key: "startTransaction", Value: true})
+	}
+
+	raw, err := bson.Marshal(cmd)
+	require.NoError(t, err)
+
+	return commandInfo{name: name, doc: raw}
+}
+
+func TestSessionTrackerStatements(t *testing.T) {
+	var st sessionTracker
+
+	steps := []struct {
+		info commandInfo
+		want int
+	}{
+		{txnCommand(t, "insert", 1, 1, true), 1},
+		{txnCommand(t, "update", 1, 1, false), 2},
+		{txnCommand(t, "insert", 2, 7, true), 1}, // another session
+		{txnCommand(t, "commitTransaction", 1, 1, false), 2},
+		{txnCommand(t, "find", 1, 2, true), 1}, // next transaction
+	}
+
+	for i, step := range steps {
+		info := step.info
+		st.observe(&info)
+
+		require.True(t, info.inTxn, "step %d", i)
+		require.Equal(t, step.want, info.txnStatement, "step %d", i)
+	}
+}
+
+func TestSessionTrackerRetryableWrite(t *testing.T) {
+	var st sessionTracker
+
+	raw, err := bson.Marshal(bson.D{
+		{Key: "insert", Value: "coll"},
+		{Key: "lsid", Value: bson.D{{Key: "id", Value: bson.Binary{Subtype: 4, Data: []byte{1}}}}},
+		{Key: "txnNumber", Value: int64(3)},
+	})
+	require.NoError(t, err)
+
+	info := commandInfo{name: "insert", doc: raw}
+	st.observe(&info)
+
+	require.Equal(t, string([]byte{1}), info.lsid)
+	require.Equal(t, int64(3), info.txnNumber)
+	require.False(t, info.inTxn, "retryable writes are not transactions")
+}
+
+func TestSessionTrackerTimeout(t *testing.T) {
+	var st sessionTracker
+
+	st.observeTimeout(marshalDoc(t, bson.D{{Key: "logicalSessionTimeoutMinutes", Value: int32(60)}}))
+	require.Equal(t, time.Hour, st.timeout)
+	st.observeTimeout(marshalDoc(t, bson.D{{Key: "logicalSessionTimeoutMinutes", Value: int32(10)}}))
+	require.Equal(t, time.Hour, st.timeout, "the longest timeout should be kept")
+
+	idle := txnCommand(t, "insert", 1, 1, true)
+	st.observe(&idle)
+	recent := txnCommand(t, "insert", 2, 1, true)
+	st.observe(&recent)
+
+	st.sessions[string([]byte{1})].lastUsed = time.Now().Add(-2 * time.Hour)
+	st.sessions[string([]byte{2})].lastUsed = time.Now().Add(-45 * time.Minute)
+	st.swept = time.Time{}
+
+	next := txnCommand(t, "insert", 3, 1, true)
+	st.observe(&next)
+
+	require.Len(t, st.sessions, 2)
+	require.NotContains(t, st.sessions, string([]byte{1}), "sessions idle past the timeout should be forgotten")
+	require.Contains(t, st.sessions, string([]byte{2}))
+}
@@ -0,0 +1,143 @@
+package mongoproxy
+
+import (
+	"fmt"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/x/bsonx/bsoncore"
+)
+
+// writeError is one entry of an injected writeErrors array.
+type writeError struct {
+	Index  int32  `bson:"index"`
+	Code   int32  `bson:"code"`
+	Errmsg string `bson:"errmsg,omitempty"`
+}
+
+// addWriteConcernError rebuilds a write reply with e as its
+// writeConcernError, replacing any the server sent. e's errorLabels are added
+// to the reply's own, as servers report them at the top level.
+func addWriteConcernError(reply bson.Raw, e *errorReply) (bson.Raw, error) {
+	elems, err := bsoncore.Document(reply).Elements()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reply: %w", err)
+	}
+
+	codeName := e.CodeName
+	if codeName == "" {
+		codeName = codeNames[e.Code]
+	}
+	errmsg := e.Errmsg
+	if errmsg == "" {
+		errmsg = "write concern error injected by mongoproxy"
+	}
+
+	wce := bsoncore.NewDocumentBuilder().AppendInt32("code", e.Code)
+	if codeName != "" {
+		wce.AppendString("codeName", codeName)
+	}
+	wce.AppendString("errmsg", errmsg)
+
+	var labels []string
+	rawElems := make([][]byte, 0, len(elems)+2)
+	for _, elem := range elems {
+		switch elem.Key() {
+		case "writeConcernError":
+			continue
+		case "errorLabels":
+			labels = appendLabels(labels, elem.Value())
+			continue
+		}
+		rawElems = append(rawElems, []byte(elem))
+	}
+
+	rawElems = append(rawElems, bsoncore.AppendDocumentElement(nil, "writeConcernError", wce.Build()))
+
+	for _, label := range e.ErrorLabels {
+		if !slices.Contains(labels, label) {
+			labels = append(labels, label)
+		}
+	}
+	if len(labels) > 0 {
+		arr := bsoncore.NewArrayBuilder()
+		for _, label := range labels {
+			arr.AppendString(label)
+		}
+		rawElems = append(rawElems, bsoncore.AppendArrayElement(nil, "errorLabels", arr.Build()))
+	}
+
+	return bson.Raw(bsoncore.BuildDocument(nil, rawElems...)), nil
+}
+
+// addWriteErrors rebuilds a write reply with errs added to its writeErrors,
+// after any the server sent. The counts the server reported are left alone,
+// since the writes did happen.
+func addWriteErrors(reply bson.Raw, errs []writeError) (bson.Raw, error) {
+	elems, err := bsoncore.Document(reply).Elements()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reply: %w", err)
+	}
+
+	arr := bsoncore.NewArrayBuilder()
+	rawElems := make([][]byte, 0, len(elems)+1)
+	for _, elem := range elems {
+		if elem.Key() != "writeErrors" {
+			rawElems = append(rawElems, []byte(elem))
+			continue
+		}
+
+		existing, ok := elem.Value().ArrayOK()
+		if !ok {
+			continue
+		}
+		values, err := existing.Values()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read writeErrors: %w", err)
+		}
+		for _, v := range values {
+			if doc, ok := v.DocumentOK(); ok {
+				arr.AppendDocument(doc)
+			}
+		}
+	}
+
+	for _, e := range errs {
+		errmsg := e.Errmsg
+		if errmsg == "" {
+			errmsg = "write error injected by mongoproxy"
+		}
+
+		we := bsoncore.NewDocumentBuilder().
+			AppendInt32("index", e.Index).
+			AppendInt32("code", e.Code)
+		if codeName, ok := codeNames[e.Code]; ok {
+			we.AppendString("codeName", codeName)
+		}
+		we.AppendString("errmsg", errmsg)
+		arr.AppendDocument(we.Build())
+	}
+
+	rawElems = append(rawElems, bsoncore.AppendArrayElement(nil, "writeErrors", arr.Build()))
+	return bson.Raw(bsoncore.BuildDocument(nil, rawElems...)), nil
+}
+
+// appendLabels appends the strings in the array v to labels.
+func appendLabels(labels []string, v bsoncore.Value) []string {
+	arr, ok := v.ArrayOK()
+	if !ok {
+		return labels
+	}
+
+	values, err := arr.Values()
+	if err != nil {
+		return labels
+	}
+
+	for _, label := range values {
+		if s, ok := label.StringValueOK(); ok {
+			labels = append(labels, s)
+		}
+	}
+	return labels
+}
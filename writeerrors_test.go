@@ -0,0 +1,54 @@
+package mongoproxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestAddWriteConcernError(t *testing.T) {
+	reply := marshalDoc(t, bson.D{
+		{Key: "n", Value: int32(3)},
+		{Key: "errorLabels", Value: bson.A{"RetryableWriteError"}},
+		{Key: "ok", Value: 1.0},
+	})
+
+	edited, err := addWriteConcernError(reply, &errorReply{
+		Code:        91,
+		ErrorLabels: []string{"RetryableWriteError", "NoWritesPerformed"},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, int32(3), edited.Lookup("n").Int32())
+	require.Equal(t, 1.0, edited.Lookup("ok").Double())
+	require.Equal(t, int32(91), edited.Lookup("writeConcernError", "code").Int32())
+	require.Equal(t, "ShutdownInProgress", edited.Lookup("writeConcernError", "codeName").StringValue())
+
+	labels, err := edited.Lookup("errorLabels").Array().Values()
+	require.NoError(t, err)
+	require.Len(t, labels, 2, "labels should be merged without duplicates")
+	require.Equal(t, "NoWritesPerformed", labels[1].StringValue())
+}
+
+func TestAddWriteErrors(t *testing.T) {
+	reply := marshalDoc(t, bson.D{
+		{Key: "n", Value: int32(4)},
+		{Key: "writeErrors", Value: bson.A{
+			bson.D{{Key: "index", Value: int32(0)}, {Key: "code", Value: int32(121)}, {Key: "errmsg", Value: "validation"}},
+		}},
+		{Key: "ok", Value: 1.0},
+	})
+
+	edited, err := addWriteErrors(reply, []writeError{{Index: 2, Code: 11000}})
+	require.NoError(t, err)
+
+	require.Equal(t, int32(4), edited.Lookup("n").Int32(), "counts should be left alone")
+
+	errs, err := edited.Lookup("writeErrors").Array().Values()
+	require.NoError(t, err)
+	require.Len(t, errs, 2)
+	require.Equal(t, int32(121), errs[0].Document().Lookup("code").Int32(), "server errors should be kept")
+	require.Equal(t, int32(2), errs[1].Document().Lookup("index").Int32())
+	require.Equal(t, "DuplicateKey", errs[1].Document().Lookup("codeName").StringValue())
+}